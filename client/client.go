@@ -21,7 +21,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 
 	"github.com/z0rr0/meerkat/packet"
 )
@@ -57,6 +59,7 @@ func main() {
 		}
 	}()
 	version := flag.Bool("version", false, "only print version")
+	genkeys := flag.Bool("genkeys", false, "generate Ed25519 signing keys pair")
 	config := flag.String("config", "meerkat_client.json", "client configuration file")
 	flag.Parse()
 
@@ -64,18 +67,27 @@ func main() {
 		fmt.Printf("%v: %v %v %v %v\n", Name, Version, Revision, GoVersion, Date)
 		return
 	}
+	if *genkeys {
+		if err := packet.GenSigningKeys(os.Stdout); err != nil {
+			loggerError.Fatalln(err)
+		}
+		return
+	}
 
 	cfg, err := Configuration(*config)
 	if err != nil {
 		loggerError.Fatalln(err)
 	}
-	loggerInfo.Printf("configuration is read\nServer %v:%v\n", cfg.Server.Host, cfg.Server.Port)
+	loggerInfo.Printf("configuration is read\nClient %v, server %v:%v\n", cfg.Name, cfg.Server.Host, cfg.Server.Port)
 
 	errChan := make(chan error)
 	defer close(errChan)
 
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
 	go packet.Interrupt(errChan)
-	go Run(cfg, errChan)
+	go Run(cfg, *config, reload, errChan)
 
 	loggerError.Println(<-errChan)
 }
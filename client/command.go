@@ -0,0 +1,144 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements client part of Meerkat project.
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+const (
+	// commandWaitDelay is max time to wait closing of command output after its exit,
+	// the output can be kept open by command descendants.
+	commandWaitDelay = time.Second
+	// killTimeout is max time to wait command exit after its kill.
+	killTimeout = 5 * time.Second
+)
+
+// errTimeout is an error when command is killed after its timeout.
+var errTimeout = errors.New("command timeout")
+
+// limitedBuffer stores only first limit bytes of written data, other ones are discarded.
+type limitedBuffer struct {
+	data      []byte
+	limit     int
+	truncated bool
+}
+
+// Write implements io.Writer interface, it never fails to not block the command.
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if free := b.limit - len(b.data); n > free {
+		p = p[:free]
+		b.truncated = true
+	}
+	b.data = append(b.data, p...)
+	return n, nil
+}
+
+// commandResult is a captured output and exit status of command execution.
+type commandResult struct {
+	stdout   *limitedBuffer
+	stderr   *limitedBuffer
+	exitCode int
+	signal   string
+	duration time.Duration
+}
+
+// result returns check result with command execution details.
+func (cr *commandResult) result(status uint8) *packet.Result {
+	return &packet.Result{
+		Status:   status,
+		ExitCode: cr.exitCode,
+		Signal:   cr.signal,
+		Stderr:   string(cr.stderr.data),
+		Duration: cr.duration,
+	}
+}
+
+// exited saves exit status of finished command.
+func (cr *commandResult) exited(cmd *exec.Cmd, start time.Time) {
+	cr.duration = time.Since(start)
+	if cmd.ProcessState == nil {
+		return
+	}
+	ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok {
+		return
+	}
+	cr.exitCode = ws.ExitStatus()
+	if ws.Signaled() {
+		cr.signal = ws.Signal().String()
+	}
+}
+
+// runCommand runs service's command with limited execution time and captured output.
+// The command is started in a new process group, which is killed on timeout with errTimeout error.
+// Waiting of command output and its exit after the kill are limited too.
+func runCommand(s *Service) (*commandResult, error) {
+	result := &commandResult{
+		stdout:   &limitedBuffer{limit: s.MaxOutput},
+		stderr:   &limitedBuffer{limit: s.MaxOutput},
+		exitCode: -1,
+	}
+	cmd := exec.Command(s.Exec, s.Args...)
+	cmd.Stdout, cmd.Stderr = result.stdout, result.stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.WaitDelay = commandWaitDelay
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return result, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timer := time.NewTimer(time.Duration(s.Timeout) * time.Second)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		result.exited(cmd, start)
+		if err == exec.ErrWaitDelay {
+			loggerError.Printf("worker [%v], command output is not closed after its exit\n", s.Name)
+			err = nil
+		}
+		return result, err
+	case <-timer.C:
+		if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+			loggerError.Printf("worker [%v], kill error: %v\n", s.Name, err)
+		}
+	}
+	select {
+	case <-done:
+		result.exited(cmd, start)
+		return result, errTimeout
+	case <-time.After(killTimeout):
+		loggerError.Printf("worker [%v], command is not stopped after kill\n", s.Name)
+		// output buffers can be still written, so they are not returned
+		return &commandResult{
+			stdout:   &limitedBuffer{},
+			stderr:   &limitedBuffer{},
+			exitCode: -1,
+			duration: time.Since(start),
+		}, errTimeout
+	}
+}
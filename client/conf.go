@@ -17,41 +17,82 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+const (
+	// defaultPendingLimit is default max number of packets waiting for acknowledgement.
+	defaultPendingLimit = 1024
+	// defaultRetryTimeout is default initial timeout in seconds before packet retransmission.
+	defaultRetryTimeout = 1
+	// defaultTimeout is default command timeout in seconds if service period is not set.
+	defaultTimeout = 60
+	// defaultMaxOutput is default max size of captured command stdout and stderr.
+	defaultMaxOutput = 65536
+	// defaultRestartDelay is default initial delay in seconds before worker restart.
+	defaultRestartDelay = 1
 )
 
 // Server is main server configuration.
 type Server struct {
-	Host      string `json:"host"`
-	Port      int    `json:"port"`
-	PublicKey string `json:"public_key"`
-	publicKey *rsa.PublicKey
-	udpConn   *net.UDPConn
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	PublicKey    string `json:"public_key"`
+	PendingLimit int    `json:"pending_limit"`
+	publicKey    *rsa.PublicKey
+	udpConn      *net.UDPConn
 }
 
 // Service is client service struct.
+// Its ID is derived from the name if it is not set explicitly.
 type Service struct {
+	ID           uint16   `json:"id"`
 	Name         string   `json:"name"`
 	Type         string   `json:"type"`
 	Exec         string   `json:"exec"`
 	Args         []string `json:"args"`
 	IgnoreErrors bool     `json:"ignore_errors"`
 	Period       int      `json:"period"`
+	Ack          bool     `json:"ack"`
+	Retries      int      `json:"retries"`
+	RetryTimeout int      `json:"retry_timeout"`
+	Format       string   `json:"format"`
+	Timeout      int      `json:"timeout"`
+	MaxOutput    int      `json:"max_output"`
+	Restart      string   `json:"restart"`
+	RestartDelay int      `json:"restart_delay"`
+	id           uint16
+}
+
+// formatsMap is command output formats by their names.
+var formatsMap = map[string]uint8{
+	"":        packet.FormatRaw,
+	"raw":     packet.FormatRaw,
+	"metrics": packet.FormatMetrics,
 }
 
 // Config is main client configuration info.
 type Config struct {
-	Server   Server    `json:"server"`
-	Services []Service `json:"services"`
+	Name       string    `json:"name"`
+	SigningKey string    `json:"signing_key"`
+	Server     Server    `json:"server"`
+	Spool      Spool     `json:"spool"`
+	Services   []Service `json:"services"`
+	clientID   []byte
+	signingKey ed25519.PrivateKey
 }
 
 // send write udp message to remove server.
@@ -64,6 +105,19 @@ func (s *Server) send(msg []byte) error {
 	return nil
 }
 
+// sendPacket encodes, encrypts and sends the packet to remote server.
+func (s *Server) sendPacket(p *packet.Packet) error {
+	b, err := packet.Encode(p)
+	if err != nil {
+		return err
+	}
+	encrypted, err := packet.Seal(s.publicKey, b)
+	if err != nil {
+		return err
+	}
+	return s.send(encrypted)
+}
+
 // UDPAddr returns server udp address.
 func (s *Server) UDPAddr() *net.UDPAddr {
 	return &net.UDPAddr{IP: net.ParseIP(s.Host), Port: s.Port}
@@ -88,12 +142,74 @@ func readConfigurationFile(name string) (*Config, error) {
 	return cfg, err
 }
 
+// prepareServices validates services settings and sets their defaults and identifiers.
+func (cfg *Config) prepareServices() error {
+	ids := make(map[uint16]string, len(cfg.Services))
+	for i := range cfg.Services {
+		s := &cfg.Services[i]
+		if s.Name == "" {
+			return fmt.Errorf("service %v: name is required", i)
+		}
+		s.id = s.ID
+		if s.id == packet.ControlServiceID {
+			s.id = packet.ServiceID(s.Name)
+		}
+		if name, ok := ids[s.id]; ok {
+			return fmt.Errorf("services %v and %v have the same id %v, set it explicitly", name, s.Name, s.id)
+		}
+		ids[s.id] = s.Name
+		if s.Ack && s.RetryTimeout < 1 {
+			s.RetryTimeout = defaultRetryTimeout
+		}
+		if s.Timeout < 1 {
+			// a command should not run longer than its period by default
+			s.Timeout = s.Period
+			if s.Timeout < 1 {
+				s.Timeout = defaultTimeout
+			}
+		}
+		if s.MaxOutput < 1 {
+			s.MaxOutput = defaultMaxOutput
+		}
+		if _, ok := formatsMap[s.Format]; !ok {
+			return fmt.Errorf("service %v: unknown format '%v'", s.Name, s.Format)
+		}
+		if s.Restart == "" {
+			s.Restart = restartNever
+		}
+		if !restartPolicies[s.Restart] {
+			return fmt.Errorf("service %v: unknown restart policy '%v'", s.Name, s.Restart)
+		}
+		if s.RestartDelay < 1 {
+			s.RestartDelay = defaultRestartDelay
+		}
+	}
+	return nil
+}
+
 // Configuration reads configuration file and does its validation.
 func Configuration(fileName string) (*Config, error) {
 	cfg, err := readConfigurationFile(fileName)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Name == "" {
+		cfg.Name, err = os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg.clientID = packet.ClientID(cfg.Name)
+	if cfg.Server.PendingLimit < 1 {
+		cfg.Server.PendingLimit = defaultPendingLimit
+	}
+	if err = cfg.prepareServices(); err != nil {
+		return nil, err
+	}
+	cfg.signingKey, err = packet.ReadSigningKey(cfg.SigningKey)
+	if err != nil {
+		return nil, err
+	}
 	data, err := ioutil.ReadFile(cfg.Server.PublicKey)
 	if err != nil {
 		return nil, err
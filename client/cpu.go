@@ -0,0 +1,258 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements client part of Meerkat project.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+const (
+	// statFile is a kernel CPU statistics file.
+	statFile = "/proc/stat"
+	// loadavgFile is a kernel load average file.
+	loadavgFile = "/proc/loadavg"
+)
+
+// cpuTimes is CPU time counters from /proc/stat.
+type cpuTimes struct {
+	user, nice, system, idle, iowait, irq, softirq, steal uint64
+}
+
+// CPUUsage is CPU utilisation in percents for a sampling period.
+type CPUUsage struct {
+	Name   string  `json:"name"`
+	User   float64 `json:"user"`
+	System float64 `json:"system"`
+	IOWait float64 `json:"iowait"`
+	Steal  float64 `json:"steal"`
+	Idle   float64 `json:"idle"`
+}
+
+// CPUStats is aggregate and per-core CPU utilisation with load averages.
+type CPUStats struct {
+	Total  CPUUsage   `json:"total"`
+	Cores  []CPUUsage `json:"cores"`
+	Load1  float64    `json:"load1"`
+	Load5  float64    `json:"load5"`
+	Load15 float64    `json:"load15"`
+}
+
+// sum returns total CPU time.
+func (t *cpuTimes) sum() uint64 {
+	return t.user + t.nice + t.system + t.idle + t.iowait + t.irq + t.softirq + t.steal
+}
+
+// delta returns counter increase, it is zero if the counter is decreased,
+// e.g. per-CPU iowait can go backwards.
+func delta(cur, old uint64) uint64 {
+	if cur < old {
+		return 0
+	}
+	return cur - old
+}
+
+// usage calculates CPU utilisation between prev and t samples, values are in range 0-100.
+func (t *cpuTimes) usage(name string, prev *cpuTimes) CPUUsage {
+	u := CPUUsage{Name: name}
+	total := delta(t.sum(), prev.sum())
+	if total == 0 {
+		return u
+	}
+	percent := func(cur, old uint64) float64 {
+		value := float64(delta(cur, old)) * 100 / float64(total)
+		if value > 100 {
+			return 100
+		}
+		return value
+	}
+	u.User = percent(t.user+t.nice, prev.user+prev.nice)
+	u.System = percent(t.system+t.irq+t.softirq, prev.system+prev.irq+prev.softirq)
+	u.IOWait = percent(t.iowait, prev.iowait)
+	u.Steal = percent(t.steal, prev.steal)
+	u.Idle = percent(t.idle, prev.idle)
+	return u
+}
+
+// readStat parses stat file and returns CPU times, aggregate "cpu" line is the first item.
+func readStat(name string) ([]string, map[string]*cpuTimes, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	names := []string{}
+	times := make(map[string]*cpuTimes)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// line format "cpu0 user nice system idle iowait irq softirq steal guest guest_nice"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 9 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		values := make([]uint64, 8)
+		for i := range values {
+			values[i], err = strconv.ParseUint(fields[i+1], 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid stat line %q: %v", scanner.Text(), err)
+			}
+		}
+		names = append(names, fields[0])
+		times[fields[0]] = &cpuTimes{
+			user:    values[0],
+			nice:    values[1],
+			system:  values[2],
+			idle:    values[3],
+			iowait:  values[4],
+			irq:     values[5],
+			softirq: values[6],
+			steal:   values[7],
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(names) == 0 || names[0] != "cpu" {
+		return nil, nil, fmt.Errorf("not found aggregate cpu line in %v", name)
+	}
+	return names, times, nil
+}
+
+// readLoadAvg returns 1, 5 and 15 minutes load averages.
+func readLoadAvg(name string) ([3]float64, error) {
+	var result [3]float64
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return result, err
+	}
+	// format "0.00 0.01 0.05 1/123 4567"
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return result, fmt.Errorf("invalid loadavg content %q", string(data))
+	}
+	for i := range result {
+		result[i], err = strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// cpuSampler calculates CPU utilisation between consecutive samples.
+type cpuSampler struct {
+	prev map[string]*cpuTimes
+}
+
+// sample reads current CPU counters and returns utilisation since previous call.
+func (cs *cpuSampler) sample() (*CPUStats, error) {
+	names, times, err := readStat(statFile)
+	if err != nil {
+		return nil, err
+	}
+	load, err := readLoadAvg(loadavgFile)
+	if err != nil {
+		return nil, err
+	}
+	prev := cs.prev
+	cs.prev = times
+	if prev == nil {
+		// first sample, there is no period yet
+		prev = times
+	}
+	stats := &CPUStats{Cores: make([]CPUUsage, 0, len(names)-1), Load1: load[0], Load5: load[1], Load15: load[2]}
+	for _, name := range names {
+		old, ok := prev[name]
+		if !ok {
+			// core became online during the period
+			old = times[name]
+		}
+		u := times[name].usage(name, old)
+		if name == "cpu" {
+			stats.Total = u
+		} else {
+			stats.Cores = append(stats.Cores, u)
+		}
+	}
+	return stats, nil
+}
+
+// metrics returns CPU utilisation metrics, cores are distinguished by "cpu" label.
+func (u *CPUUsage) metrics(ts int64) []packet.Metric {
+	labels := map[string]string{"cpu": u.Name}
+	return []packet.Metric{
+		{Name: "cpu.user", Value: u.User, Unit: "percent", Labels: labels, Timestamp: ts},
+		{Name: "cpu.system", Value: u.System, Unit: "percent", Labels: labels, Timestamp: ts},
+		{Name: "cpu.iowait", Value: u.IOWait, Unit: "percent", Labels: labels, Timestamp: ts},
+		{Name: "cpu.steal", Value: u.Steal, Unit: "percent", Labels: labels, Timestamp: ts},
+		{Name: "cpu.idle", Value: u.Idle, Unit: "percent", Labels: labels, Timestamp: ts},
+	}
+}
+
+// metrics returns CPU utilisation and load average metrics.
+func (cs *CPUStats) metrics(t time.Time) []packet.Metric {
+	ts := t.UnixNano()
+	metrics := cs.Total.metrics(ts)
+	for i := range cs.Cores {
+		metrics = append(metrics, cs.Cores[i].metrics(ts)...)
+	}
+	return append(metrics,
+		packet.Metric{Name: "load.1", Value: cs.Load1, Timestamp: ts},
+		packet.Metric{Name: "load.5", Value: cs.Load5, Timestamp: ts},
+		packet.Metric{Name: "load.15", Value: cs.Load15, Timestamp: ts},
+	)
+}
+
+// workerCPU is a CPU utilisation service worker.
+func workerCPU(s *Service, serviceID uint16, packetSize int, co chan<- *packet.Packet, stop <-chan struct{}) error {
+	sampler := &cpuSampler{}
+	if _, err := sampler.sample(); err != nil {
+		loggerError.Printf("worker [%v], error: %v\n", s.Name, err)
+		return err
+	}
+	loggerInfo.Printf("run worker [%v], period=%v seconds\n", s.Name, s.Period)
+	d := time.Duration(s.Period) * time.Second
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-timer.C:
+		}
+		stats, err := sampler.sample()
+		if err == nil {
+			err = sendMetrics(s, serviceID, packetSize, stats.metrics(time.Now()), co)
+		}
+		if err != nil {
+			loggerError.Printf("worker [%v] [ignore=%v], error: %v\n", s.Name, s.IgnoreErrors, err)
+			if !s.IgnoreErrors {
+				return err
+			}
+		}
+		timer.Reset(d)
+	}
+}
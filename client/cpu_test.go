@@ -0,0 +1,66 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestCPUTimesUsage(t *testing.T) {
+	cases := []struct {
+		name       string
+		prev, cur  cpuTimes
+		user, idle float64
+		iowait     float64
+	}{
+		{
+			name: "regular",
+			prev: cpuTimes{user: 100, idle: 100, iowait: 50},
+			cur:  cpuTimes{user: 150, idle: 150, iowait: 50},
+			user: 50, idle: 50,
+		},
+		{
+			name: "decreased iowait",
+			prev: cpuTimes{user: 100, idle: 100, iowait: 50},
+			cur:  cpuTimes{user: 150, idle: 151, iowait: 49},
+			user: 50, idle: 51,
+		},
+		{
+			name: "decreased total",
+			prev: cpuTimes{user: 100, idle: 100, iowait: 50},
+			cur:  cpuTimes{user: 100, idle: 100, iowait: 40},
+		},
+		{
+			name: "not changed",
+			prev: cpuTimes{user: 100, idle: 100},
+			cur:  cpuTimes{user: 100, idle: 100},
+		},
+	}
+	for _, c := range cases {
+		u := c.cur.usage("cpu0", &c.prev)
+		if u.Name != "cpu0" {
+			t.Errorf("%v: invalid name %v", c.name, u.Name)
+		}
+		if u.User != c.user || u.Idle != c.idle || u.IOWait != c.iowait {
+			t.Errorf("%v: unexpected usage %+v", c.name, u)
+		}
+		for _, v := range []float64{u.User, u.System, u.IOWait, u.Steal, u.Idle} {
+			if v < 0 || v > 100 {
+				t.Errorf("%v: value %v is out of range", c.name, v)
+			}
+		}
+	}
+}
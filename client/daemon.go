@@ -17,100 +17,298 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
+	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
+	"os"
 	"os/exec"
-	"sync"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/z0rr0/meerkat/packet"
 )
 
+// errPayloadSize is an error when service's payload exceeds max message size.
+var errPayloadSize = errors.New("payload exceeds max message size")
+
+// workerFunc is a service worker, it sends service's packets to the consumer until an error or stop.
+type workerFunc func(*Service, uint16, int, chan<- *packet.Packet, <-chan struct{}) error
+
 var (
-	workersMap = map[string]func(*Service, uint16, int, chan<- *packet.Packet, *sync.WaitGroup){
+	workersMap = map[string]workerFunc{
 		"command": workerCommand,
-		//"memory"
-		//"cpu"
+		"memory":  workerMemory,
+		"cpu":     workerCPU,
+		"nagios":  workerNagios,
 	}
 )
 
 // workerCommand is a common service worker.
-func workerCommand(s *Service, serviceID uint16, packetSize int, co chan<- *packet.Packet, wg *sync.WaitGroup) {
-	var err error
-	defer wg.Done()
-
-	buf := make([]byte, packetSize)
-	p := &packet.Packet{ServiceID: serviceID, Payload: make([]byte, packetSize)}
-
+func workerCommand(s *Service, serviceID uint16, packetSize int, co chan<- *packet.Packet, stop <-chan struct{}) error {
 	loggerInfo.Printf("run worker [%v], period=%v seconds\n", s.Name, s.Period)
 	d := time.Duration(s.Period) * time.Second
 	timer := time.NewTimer(d)
 	defer timer.Stop()
 
-	for range timer.C {
-		buf, err = exec.Command(s.Exec, s.Args...).Output()
-		if err != nil {
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-timer.C:
+		}
+		out, err := runCommand(s)
+		if out.stdout.truncated {
+			loggerError.Printf("worker [%v], output is truncated to %v bytes\n", s.Name, s.MaxOutput)
+		}
+		result := out.result(packet.StatusOK)
+		switch err.(type) {
+		case nil:
+			if formatsMap[s.Format] == packet.FormatMetrics {
+				result.Metrics, err = parseMetrics(out.stdout.data, time.Now())
+				if err != nil {
+					loggerError.Printf("worker [%v], invalid metrics: %v\n", s.Name, err)
+					result.Output = string(out.stdout.data)
+				}
+			} else {
+				result.Output = string(out.stdout.data)
+			}
+		case *exec.ExitError:
+			loggerError.Printf("worker [%v] [ignore=%v], error: %v, stderr: %q\n", s.Name, s.IgnoreErrors, err, out.stderr.data)
+			result.Status = packet.StatusFailed
+			result.Output = string(out.stdout.data)
+		default:
 			loggerError.Printf("worker [%v] [ignore=%v], error: %v\n", s.Name, s.IgnoreErrors, err)
-			if !s.IgnoreErrors {
-				// error without ignoring, exit
-				return
+			result.Status = packet.StatusFailed
+			if err == errTimeout {
+				result.Status = packet.StatusTimeout
 			}
+			result.Output = err.Error()
 		}
-		if l := len(buf); l > packetSize {
-			loggerError.Printf("worker [%v], too match packet %v bytes", s.Name, l)
-		} else {
-			loggerInfo.Printf("worker [%v]: %v bytes\n", s.Name, l)
-			copy(p.Payload, buf[0:l])
-			co <- p
+		sendResult(s, serviceID, packetSize, result, co)
+		if result.Status != packet.StatusOK && !s.IgnoreErrors {
+			// error without ignoring, exit
+			return err
 		}
 		timer.Reset(d)
 	}
 }
 
-// consume handles command outputs.
-func consume(s *Server, co <-chan *packet.Packet) {
-	for out := range co {
-		// send to server
-		encrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, s.publicKey, packet.Encode(out), nil)
+// parseMetrics parses command output with a metric per line in format
+// "name value [unit] [label=value ...]", empty lines and lines started with "#" are skipped.
+func parseMetrics(out []byte, t time.Time) ([]packet.Metric, error) {
+	metrics := []packet.Metric{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid metric line %q", line)
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
 		if err != nil {
-			loggerError.Printf("error encrypted, worker [%v] - %v bytes: %v\n", out.ServiceID, len(out.Payload), err)
-		} else {
-			loggerInfo.Printf("handle worker [%v] message [%v]: \n%v\n", out.ServiceID, len(out.Payload), string(out.Payload))
-			err = s.send(encrypted)
-			if err != nil {
-				loggerError.Printf("error during message sending: %v\n", err)
+			return nil, fmt.Errorf("invalid metric line %q: %v", line, err)
+		}
+		m := packet.Metric{Name: fields[0], Value: value, Timestamp: t.UnixNano()}
+		for i, field := range fields[2:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) == 1 {
+				if i > 0 {
+					return nil, fmt.Errorf("invalid metric label %q", field)
+				}
+				m.Unit = field
+				continue
+			}
+			if m.Labels == nil {
+				m.Labels = make(map[string]string)
 			}
+			m.Labels[kv[0]] = kv[1]
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, scanner.Err()
+}
+
+// sendPayload sends a new packet with service's payload to the consumer.
+// The payload is not sent and errPayloadSize is returned if it exceeds packetSize.
+func sendPayload(s *Service, serviceID uint16, packetSize int, format uint8, payload []byte, co chan<- *packet.Packet) error {
+	l := len(payload)
+	if l > packetSize {
+		loggerError.Printf("worker [%v], too big payload %v bytes, max %v\n", s.Name, l, packetSize)
+		return errPayloadSize
+	}
+	loggerInfo.Printf("worker [%v]: %v bytes\n", s.Name, l)
+	co <- &packet.Packet{ServiceID: serviceID, Format: format, Measured: time.Now().UnixNano(), Payload: payload}
+	return nil
+}
+
+// sendResult sends a new packet with service's check result to the consumer.
+func sendResult(s *Service, serviceID uint16, packetSize int, result *packet.Result, co chan<- *packet.Packet) error {
+	return sendPayload(s, serviceID, packetSize, packet.FormatResult, packet.EncodeResult(result), co)
+}
+
+// sendMetrics sends encoded service's metrics to the consumer,
+// they are split to several packets if the payload exceeds packetSize.
+func sendMetrics(s *Service, serviceID uint16, packetSize int, metrics []packet.Metric, co chan<- *packet.Packet) error {
+	payload := packet.EncodeMetrics(metrics)
+	if n := len(metrics); len(payload) > packetSize && n > 1 {
+		if err := sendMetrics(s, serviceID, packetSize, metrics[:n/2], co); err != nil {
+			return err
 		}
+		return sendMetrics(s, serviceID, packetSize, metrics[n/2:], co)
 	}
+	return sendPayload(s, serviceID, packetSize, packet.FormatMetrics, payload, co)
 }
 
-// Run starts main services.
-func Run(cfg *Config, ec chan error) {
-	var wg sync.WaitGroup
+// worker is a running service worker.
+type worker struct {
+	service *Service
+	stop    chan struct{}
+	done    chan struct{}
+}
 
-	l := len(cfg.Services)
-	if l == 0 {
-		ec <- errors.New("no services for running")
+// update is a services update for the consumer.
+type update struct {
+	services     map[uint16]*Service
+	registration *packet.Packet
+}
+
+// runner starts, stops and reloads services workers.
+type runner struct {
+	cfg        *Config
+	packetSize int
+	co         chan *packet.Packet
+	updates    chan *update
+	finished   chan *worker
+	workers    map[uint16]*worker
+}
+
+// start runs the service worker under supervision.
+func (r *runner) start(s *Service) {
+	run, ok := workersMap[s.Type]
+	if !ok {
+		loggerError.Printf("unknown service [%v] type: '%v'\n", s.Name, s.Type)
 		return
 	}
-	wg.Add(l)
+	w := &worker{service: s, stop: make(chan struct{}), done: make(chan struct{})}
+	r.workers[s.id] = w
+	go func() {
+		supervise(s, s.id, run, r.packetSize, r.co, w.stop)
+		close(w.done)
+		select {
+		case r.finished <- w:
+		case <-w.stop:
+			// stopped by the runner
+		}
+	}()
+}
 
-	co := make(chan *packet.Packet)
-	defer close(co) // only if no working services
+// stop stops the worker and waits its finish.
+func (r *runner) stop(w *worker) {
+	close(w.stop)
+	<-w.done
+	delete(r.workers, w.service.id)
+	loggerInfo.Printf("worker [%v] is stopped\n", w.service.Name)
+}
 
-	maxPacketSize := packet.MaxPacketPayloadSize(cfg.Server.publicKey)
-	go consume(&cfg.Server, co)
+// notify sends current services and their registration to the consumer.
+func (r *runner) notify() {
+	services := make(map[uint16]*Service, len(r.cfg.Services)+1)
+	services[packet.ControlServiceID] = &controlService
+	for i := range r.cfg.Services {
+		s := &r.cfg.Services[i]
+		services[s.id] = s
+	}
+	for id, w := range r.workers {
+		services[id] = w.service
+	}
+	r.updates <- &update{services: services, registration: r.cfg.registration()}
+}
 
-	for i, s := range cfg.Services {
-		if worker, ok := workersMap[s.Type]; ok {
-			go worker(&cfg.Services[i], uint16(i), maxPacketSize, co, &wg)
-		} else {
-			loggerError.Printf("unknown service [%v] type: '%v'\n", s.Name, s.Type)
-			wg.Done()
+// reload reads services from the configuration file, stops removed workers,
+// starts new ones and restarts changed ones. Pending packets are not dropped.
+func (r *runner) reload(fileName string) error {
+	cfg, err := readConfigurationFile(fileName)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Services) == 0 {
+		return errors.New("no services for running")
+	}
+	if err = cfg.prepareServices(); err != nil {
+		return err
+	}
+	if cfg.Server.Host != r.cfg.Server.Host || cfg.Server.Port != r.cfg.Server.Port ||
+		cfg.Server.PublicKey != r.cfg.Server.PublicKey || cfg.SigningKey != r.cfg.SigningKey ||
+		cfg.Spool != r.cfg.Spool || (cfg.Name != "" && cfg.Name != r.cfg.Name) {
+		loggerError.Println("only services settings are reloaded, other changes require restart")
+	}
+	services := make(map[uint16]*Service, len(cfg.Services))
+	for i := range cfg.Services {
+		s := &cfg.Services[i]
+		services[s.id] = s
+	}
+	for id, w := range r.workers {
+		if s, ok := services[id]; ok && reflect.DeepEqual(s, w.service) {
+			// not changed service continues to work
+			delete(services, id)
+			continue
+		}
+		r.stop(w)
+	}
+	r.cfg.Services = cfg.Services
+	r.notify()
+	for i := range cfg.Services {
+		if s := &cfg.Services[i]; services[s.id] == s {
+			r.start(s)
+		}
+	}
+	return nil
+}
+
+// Run starts main services, they are reloaded after a signal from the reload channel.
+func Run(cfg *Config, fileName string, reload <-chan os.Signal, ec chan error) {
+	if len(cfg.Services) == 0 {
+		ec <- errors.New("no services for running")
+		return
+	}
+	r := &runner{
+		cfg:        cfg,
+		packetSize: packet.MaxMessageSize(cfg.Server.publicKey),
+		co:         make(chan *packet.Packet),
+		updates:    make(chan *update),
+		finished:   make(chan *worker),
+		workers:    make(map[uint16]*worker, len(cfg.Services)),
+	}
+	consumed := make(chan struct{})
+	go func() {
+		consume(cfg, r.co, r.updates)
+		close(consumed)
+	}()
+	r.notify()
+	for i := range cfg.Services {
+		r.start(&cfg.Services[i])
+	}
+	for len(r.workers) > 0 {
+		select {
+		case <-reload:
+			loggerInfo.Printf("reload configuration %v\n", fileName)
+			if err := r.reload(fileName); err != nil {
+				loggerError.Printf("configuration is not reloaded: %v\n", err)
+			}
+		case w := <-r.finished:
+			if r.workers[w.service.id] == w {
+				delete(r.workers, w.service.id)
+			}
 		}
 	}
-	wg.Wait()
+	// all workers are stopped, send their last packets
+	close(r.co)
+	<-consumed
 	ec <- nil
 }
@@ -0,0 +1,149 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements client part of Meerkat project.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+const (
+	// meminfoFile is a kernel memory usage statistics file.
+	meminfoFile = "/proc/meminfo"
+)
+
+// MemoryStats is memory usage info in bytes.
+type MemoryStats struct {
+	Total     uint64 `json:"total"`
+	Free      uint64 `json:"free"`
+	Available uint64 `json:"available"`
+	Used      uint64 `json:"used"`
+	Buffers   uint64 `json:"buffers"`
+	Cached    uint64 `json:"cached"`
+	SwapTotal uint64 `json:"swap_total"`
+	SwapFree  uint64 `json:"swap_free"`
+	SwapUsed  uint64 `json:"swap_used"`
+}
+
+// readMemInfo parses meminfo file and returns its values in bytes.
+func readMemInfo(name string) (map[string]uint64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// line format "MemTotal:       16318484 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid meminfo line %q: %v", scanner.Text(), err)
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			value *= 1024
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = value
+	}
+	return values, scanner.Err()
+}
+
+// memoryStats returns current memory usage info.
+func memoryStats() (*MemoryStats, error) {
+	v, err := readMemInfo(meminfoFile)
+	if err != nil {
+		return nil, err
+	}
+	ms := &MemoryStats{
+		Total:     v["MemTotal"],
+		Free:      v["MemFree"],
+		Available: v["MemAvailable"],
+		Buffers:   v["Buffers"],
+		Cached:    v["Cached"] + v["SReclaimable"],
+		SwapTotal: v["SwapTotal"],
+		SwapFree:  v["SwapFree"],
+	}
+	if used := ms.Free + ms.Buffers + ms.Cached; ms.Total > used {
+		ms.Used = ms.Total - used
+	}
+	if ms.SwapTotal > ms.SwapFree {
+		ms.SwapUsed = ms.SwapTotal - ms.SwapFree
+	}
+	return ms, nil
+}
+
+// metrics returns memory usage metrics.
+func (ms *MemoryStats) metrics(t time.Time) []packet.Metric {
+	ts := t.UnixNano()
+	values := []struct {
+		name  string
+		value uint64
+	}{
+		{"memory.total", ms.Total},
+		{"memory.free", ms.Free},
+		{"memory.available", ms.Available},
+		{"memory.used", ms.Used},
+		{"memory.buffers", ms.Buffers},
+		{"memory.cached", ms.Cached},
+		{"swap.total", ms.SwapTotal},
+		{"swap.free", ms.SwapFree},
+		{"swap.used", ms.SwapUsed},
+	}
+	metrics := make([]packet.Metric, len(values))
+	for i, v := range values {
+		metrics[i] = packet.Metric{Name: v.name, Value: float64(v.value), Unit: "bytes", Timestamp: ts}
+	}
+	return metrics
+}
+
+// workerMemory is a memory usage service worker.
+func workerMemory(s *Service, serviceID uint16, packetSize int, co chan<- *packet.Packet, stop <-chan struct{}) error {
+	loggerInfo.Printf("run worker [%v], period=%v seconds\n", s.Name, s.Period)
+	d := time.Duration(s.Period) * time.Second
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-timer.C:
+		}
+		ms, err := memoryStats()
+		if err == nil {
+			err = sendMetrics(s, serviceID, packetSize, ms.metrics(time.Now()), co)
+		}
+		if err != nil {
+			loggerError.Printf("worker [%v] [ignore=%v], error: %v\n", s.Name, s.IgnoreErrors, err)
+			if !s.IgnoreErrors {
+				return err
+			}
+		}
+		timer.Reset(d)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements client part of Meerkat project.
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+// perfdataFields is names of optional perfdata fields after value.
+var perfdataFields = []string{"warn", "crit", "min", "max"}
+
+// splitPerfdata splits perfdata to items by spaces, single quoted labels can contain spaces.
+func splitPerfdata(perfdata string) []string {
+	var (
+		items  []string
+		quoted bool
+	)
+	item := []rune{}
+	for _, c := range perfdata {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+			item = append(item, c)
+		case c == ' ' && !quoted:
+			if len(item) > 0 {
+				items = append(items, string(item))
+				item = item[:0]
+			}
+		default:
+			item = append(item, c)
+		}
+	}
+	if len(item) > 0 {
+		items = append(items, string(item))
+	}
+	return items
+}
+
+// parsePerfdata parses Nagios plugin performance data
+// "'label'=value[UOM];[warn];[crit];[min];[max] ...", thresholds are stored as labels.
+func parsePerfdata(perfdata string, t time.Time) ([]packet.Metric, error) {
+	metrics := []packet.Metric{}
+	for _, item := range splitPerfdata(perfdata) {
+		i := strings.LastIndex(item, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid perfdata %q", item)
+		}
+		name := strings.Replace(strings.Trim(item[:i], "'"), "''", "'", -1)
+		values := strings.Split(item[i+1:], ";")
+		number := strings.TrimRightFunc(values[0], func(c rune) bool {
+			return !strings.ContainsRune("0123456789.", c)
+		})
+		if number == "" && values[0] == "U" {
+			// undetermined value
+			continue
+		}
+		value, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid perfdata %q: %v", item, err)
+		}
+		m := packet.Metric{Name: name, Value: value, Unit: values[0][len(number):], Timestamp: t.UnixNano()}
+		for j, v := range values[1:] {
+			if v == "" || j >= len(perfdataFields) {
+				continue
+			}
+			if m.Labels == nil {
+				m.Labels = make(map[string]string)
+			}
+			m.Labels[perfdataFields[j]] = v
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// parseNagiosOutput parses Nagios plugin output: text and perfdata of the first line,
+// long text lines and perfdata lines after the next "|" separator.
+func parseNagiosOutput(out []byte, t time.Time) (string, []packet.Metric, error) {
+	var text, perfdata []string
+	inPerfdata := false
+	for i, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		if inPerfdata {
+			perfdata = append(perfdata, line)
+			continue
+		}
+		parts := strings.SplitN(line, "|", 2)
+		if i == 0 || strings.TrimSpace(parts[0]) != "" {
+			text = append(text, strings.TrimSpace(parts[0]))
+		}
+		if len(parts) == 2 {
+			perfdata = append(perfdata, parts[1])
+			// all lines after the second separator are perfdata
+			inPerfdata = i > 0
+		}
+	}
+	metrics, err := parsePerfdata(strings.Join(perfdata, " "), t)
+	return strings.Join(text, "\n"), metrics, err
+}
+
+// nagiosStatus returns check status by plugin exit error.
+func nagiosStatus(err error) (uint8, error) {
+	if err == nil {
+		return packet.StatusOK, nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return packet.StatusUnknown, err
+	}
+	ws, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Exited() || ws.ExitStatus() > int(packet.StatusUnknown) {
+		return packet.StatusUnknown, nil
+	}
+	return uint8(ws.ExitStatus()), nil
+}
+
+// workerNagios is a Nagios plugins compatible service worker.
+func workerNagios(s *Service, serviceID uint16, packetSize int, co chan<- *packet.Packet, stop <-chan struct{}) error {
+	loggerInfo.Printf("run worker [%v], period=%v seconds\n", s.Name, s.Period)
+	d := time.Duration(s.Period) * time.Second
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-timer.C:
+		}
+		out, err := runCommand(s)
+		var result *packet.Result
+		if err == errTimeout {
+			loggerError.Printf("worker [%v] [ignore=%v], timeout %v seconds\n", s.Name, s.IgnoreErrors, s.Timeout)
+			result = out.result(packet.StatusTimeout)
+			result.Output = err.Error()
+		} else {
+			var status uint8
+			status, err = nagiosStatus(err)
+			result = out.result(status)
+			if err != nil {
+				loggerError.Printf("worker [%v] [ignore=%v], error: %v\n", s.Name, s.IgnoreErrors, err)
+				result.Output = err.Error()
+			} else {
+				output, metrics, perfErr := parseNagiosOutput(out.stdout.data, time.Now())
+				if perfErr != nil {
+					loggerError.Printf("worker [%v], invalid perfdata: %v\n", s.Name, perfErr)
+				}
+				result.Output, result.Metrics = output, metrics
+			}
+		}
+		sendResult(s, serviceID, packetSize, result, co)
+		if err != nil && !s.IgnoreErrors {
+			return err
+		}
+		timer.Reset(d)
+	}
+}
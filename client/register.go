@@ -0,0 +1,66 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements client part of Meerkat project.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+const (
+	// osReleaseFile is a kernel release file.
+	osReleaseFile = "/proc/sys/kernel/osrelease"
+)
+
+// osInfo returns OS name, architecture and kernel release if it is available.
+func osInfo() string {
+	info := runtime.GOOS + "/" + runtime.GOARCH
+	if data, err := ioutil.ReadFile(osReleaseFile); err == nil {
+		info += " " + strings.TrimSpace(string(data))
+	}
+	return info
+}
+
+// registration returns a control packet which registers the client's host info and services on the server.
+func (cfg *Config) registration() *packet.Packet {
+	hostname, err := os.Hostname()
+	if err != nil {
+		loggerError.Printf("hostname error: %v\n", err)
+	}
+	reg := &packet.Registration{
+		Hostname: hostname,
+		OS:       osInfo(),
+		Version:  Version,
+		Revision: Revision,
+		Services: make([]packet.ServiceInfo, len(cfg.Services)),
+	}
+	for i := range cfg.Services {
+		s := &cfg.Services[i]
+		reg.Services[i] = packet.ServiceInfo{ID: s.id, Name: s.Name, Type: s.Type, Period: uint32(s.Period)}
+	}
+	return &packet.Packet{
+		ServiceID: packet.ControlServiceID,
+		Format:    packet.FormatRegistration,
+		Measured:  time.Now().UnixNano(),
+		Payload:   packet.EncodeRegistration(reg),
+	}
+}
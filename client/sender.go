@@ -0,0 +1,432 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements client part of Meerkat project.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+const (
+	// retryCheckPeriod is a period to check pending packets.
+	retryCheckPeriod = 100 * time.Millisecond
+	// spoolCheckPeriod is a period to check server availability when it is offline.
+	spoolCheckPeriod = 5 * time.Second
+	// spoolProbeTimeout is a timeout of spooled packet acknowledgement.
+	spoolProbeTimeout = 5 * time.Second
+	// spoolDrainLimit is a max number of sent spooled packets which wait for acknowledgement.
+	spoolDrainLimit = 16
+)
+
+// controlService is a pseudo-service of client's control messages,
+// they are always acknowledged.
+var controlService = Service{Name: "control", Ack: true, Retries: 5, RetryTimeout: defaultRetryTimeout}
+
+// pending is a sent packet waiting for server acknowledgement.
+type pending struct {
+	packet   *packet.Packet
+	service  *Service
+	attempts int
+	deadline time.Time
+	spooled  string
+}
+
+// sender signs and sends packets to the server,
+// it retransmits packets which are not acknowledged in time
+// and spools them to the disk while the server is unavailable.
+type sender struct {
+	cfg       *Config
+	services  map[uint16]*Service
+	sequence  uint64
+	messageID uint32
+	pending   map[uint64]*pending
+	spool     *spool
+	offline   bool
+	// inflight is a set of sent spooled files which wait for acknowledgement
+	inflight map[string]bool
+	// sequences are numbers of sent spooled files, their repeated sending keeps the same number
+	sequences map[string]uint64
+}
+
+// newSender returns new packets sender.
+func newSender(cfg *Config, services map[uint16]*Service) *sender {
+	sp, err := newSpool(&cfg.Spool)
+	if err != nil {
+		loggerError.Printf("spool is disabled: %v\n", err)
+		sp = nil
+	}
+	// sequence is monotonic between client restarts
+	sequence := uint64(time.Now().UnixNano())
+	sd := &sender{
+		cfg:       cfg,
+		services:  services,
+		sequence:  sequence,
+		messageID: uint32(sequence),
+		pending:   make(map[uint64]*pending),
+		spool:     sp,
+		inflight:  make(map[string]bool),
+		sequences: make(map[string]uint64),
+		// check spooled packets of previous runs
+		offline: sp != nil,
+	}
+	return sd
+}
+
+// service returns the packet's worker service.
+// Packets of removed or renamed services are sent with their own flags and control messages retry settings.
+func (sd *sender) service(p *packet.Packet) *Service {
+	if s, ok := sd.services[p.ServiceID]; ok {
+		return s
+	}
+	return &Service{
+		Name:         fmt.Sprintf("removed %v", p.ServiceID),
+		Ack:          p.Flags&packet.FlagAck != 0,
+		Retries:      controlService.Retries,
+		RetryTimeout: controlService.RetryTimeout,
+	}
+}
+
+// handle splits service output to fragments and sends them.
+func (sd *sender) handle(out *packet.Packet) {
+	s := sd.service(out)
+	out.ClientID = sd.cfg.clientID
+	out.Period = uint32(s.Period)
+	if s.Ack {
+		out.Flags |= packet.FlagAck
+	}
+	sd.messageID++
+	fragments, err := packet.Split(out, sd.messageID, packet.MaxPacketPayloadSize(sd.cfg.Server.publicKey))
+	if err != nil {
+		loggerError.Printf("error splitting, worker [%v] - %v bytes: %v\n", s.Name, len(out.Payload), err)
+		return
+	}
+	loggerInfo.Printf("handle worker [%v] message [%v] of %v fragments\n", s.Name, len(out.Payload), len(fragments))
+	for _, f := range fragments {
+		sd.deliver(f, s)
+	}
+}
+
+// deliver sends the packet or spools it if the server is offline
+// or previously spooled packets are not sent yet, so packets order is kept.
+func (sd *sender) deliver(p *packet.Packet, s *Service) {
+	if sd.offline || (sd.spool != nil && sd.spool.len() > 0) {
+		sd.store(p, s)
+		sd.drain()
+		return
+	}
+	if err := sd.send(p, s, 0); err != nil {
+		loggerError.Printf("error during message sending: %v\n", err)
+		if p.Flags&packet.FlagAck == 0 {
+			sd.fail(p, s)
+		}
+	}
+}
+
+// fail marks the server as offline and spools the packet.
+func (sd *sender) fail(p *packet.Packet, s *Service) {
+	if sd.spool == nil {
+		return
+	}
+	if !sd.offline {
+		loggerError.Println("server is offline, packets are spooled")
+		sd.offline = true
+	}
+	sd.store(p, s)
+}
+
+// store saves the signed packet to the spool.
+func (sd *sender) store(p *packet.Packet, s *Service) {
+	if p.Signature == nil {
+		if err := packet.Sign(p, sd.cfg.signingKey); err != nil {
+			loggerError.Printf("error signing, worker [%v]: %v\n", s.Name, err)
+			return
+		}
+	}
+	b, err := packet.Encode(p)
+	if err == nil {
+		err = sd.spool.push(b)
+	}
+	if err != nil {
+		loggerError.Printf("worker [%v] packet is lost, spool error: %v\n", s.Name, err)
+	}
+}
+
+// send stamps, signs and sends the packet to the server.
+// New packet gets next sequence number, retransmitted one keeps its number,
+// so the server doesn't handle it twice if only acknowledgement was lost.
+// The packet is added to pending queue if it requires acknowledgement.
+func (sd *sender) send(p *packet.Packet, s *Service, attempts int) error {
+	if p.Sequence == 0 {
+		sd.sequence++
+		p.Sequence = sd.sequence
+	}
+	p.Timestamp = time.Now().UnixNano()
+	if err := packet.Sign(p, sd.cfg.signingKey); err != nil {
+		return err
+	}
+	if p.Flags&packet.FlagAck != 0 {
+		timeout := time.Duration(s.RetryTimeout) * time.Second << uint(attempts)
+		sd.wait(&pending{packet: p, service: s, attempts: attempts, deadline: time.Now().Add(timeout)})
+	}
+	return sd.cfg.Server.sendPacket(p)
+}
+
+// wait adds the item to pending queue, the oldest packet is dropped if the queue is full.
+func (sd *sender) wait(item *pending) {
+	if len(sd.pending) >= sd.cfg.Server.PendingLimit {
+		oldest := item.packet.Sequence
+		for seq := range sd.pending {
+			if seq < oldest {
+				oldest = seq
+			}
+		}
+		dropped := sd.pending[oldest]
+		delete(sd.pending, oldest)
+		loggerError.Printf("pending queue is full, worker [%v] packet %v is dropped\n", dropped.service.Name, oldest)
+		if dropped.spooled != "" {
+			delete(sd.inflight, dropped.spooled)
+		}
+	}
+	sd.pending[item.packet.Sequence] = item
+}
+
+// acknowledge removes acknowledged packet from pending queue.
+// Acknowledged spooled packet is removed from the spool,
+// it means that the server is available again, so next spooled packets are sent.
+func (sd *sender) acknowledge(seq uint64) {
+	item, ok := sd.pending[seq]
+	if !ok {
+		return
+	}
+	delete(sd.pending, seq)
+	loggerInfo.Printf("worker [%v] packet %v is acknowledged\n", item.service.Name, seq)
+	if item.spooled != "" {
+		delete(sd.inflight, item.spooled)
+		delete(sd.sequences, item.spooled)
+		if err := sd.spool.remove(item.spooled); err != nil {
+			loggerError.Printf("spool error: %v\n", err)
+		}
+		if sd.offline {
+			loggerInfo.Println("server is online, spooled packets are sent")
+			sd.offline = false
+		}
+		sd.drain()
+	}
+}
+
+// retry resends pending packets with expired deadline.
+func (sd *sender) retry(now time.Time) {
+	expired := []uint64{}
+	for seq, item := range sd.pending {
+		if !item.deadline.After(now) {
+			expired = append(expired, seq)
+		}
+	}
+	// keep packets order
+	sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+	for _, seq := range expired {
+		item, ok := sd.pending[seq]
+		if !ok {
+			// dropped during previous resending
+			continue
+		}
+		delete(sd.pending, seq)
+		if item.spooled != "" {
+			// server doesn't respond, the packet stays in the spool
+			delete(sd.inflight, item.spooled)
+			if !sd.offline {
+				loggerError.Printf("spooled packet %v is not acknowledged, server is offline\n", seq)
+				sd.offline = true
+			}
+			continue
+		}
+		if item.attempts >= item.service.Retries {
+			loggerError.Printf("worker [%v] packet %v is not acknowledged after %v attempts\n", item.service.Name, seq, item.attempts+1)
+			sd.fail(item.packet, item.service)
+			continue
+		}
+		if err := sd.send(item.packet, item.service, item.attempts+1); err != nil {
+			loggerError.Printf("error during message resending: %v\n", err)
+		}
+	}
+}
+
+// unspool reads and decodes the spooled packet, invalid packets are removed.
+func (sd *sender) unspool(name string, b []byte) (*packet.Packet, *Service) {
+	p, err := packet.Decode(b)
+	if err == nil {
+		return p, sd.service(p)
+	}
+	loggerError.Printf("spooled packet %v is dropped: %v\n", name, err)
+	if err = sd.spool.remove(name); err != nil {
+		loggerError.Printf("spool error: %v\n", err)
+	}
+	return nil, nil
+}
+
+// sendSpooled sends the spooled packet with acknowledgement request,
+// its file is removed from the spool only after acknowledgement.
+// Packet which was never sent gets new sequence number, repeated sending of the same file keeps it,
+// so the server doesn't handle the packet twice if only acknowledgement was lost.
+func (sd *sender) sendSpooled(name string, p *packet.Packet, s *Service) error {
+	if p.Sequence == 0 {
+		seq, ok := sd.sequences[name]
+		if !ok {
+			sd.sequence++
+			seq = sd.sequence
+			sd.sequences[name] = seq
+		}
+		p.Sequence = seq
+	}
+	p.Flags |= packet.FlagAck
+	p.Timestamp = time.Now().UnixNano()
+	if err := packet.Sign(p, sd.cfg.signingKey); err != nil {
+		return err
+	}
+	sd.inflight[name] = true
+	sd.wait(&pending{packet: p, service: s, deadline: time.Now().Add(spoolProbeTimeout), spooled: name})
+	if err := sd.cfg.Server.sendPacket(p); err != nil {
+		delete(sd.pending, p.Sequence)
+		delete(sd.inflight, name)
+		return err
+	}
+	return nil
+}
+
+// check sends the oldest spooled packet to check server availability,
+// it waits while sent spooled packets are not acknowledged or expired.
+func (sd *sender) check() {
+	if !sd.offline || len(sd.inflight) > 0 {
+		return
+	}
+	for {
+		name, b, err := sd.spool.next(sd.inflight)
+		if err != nil {
+			loggerError.Printf("spool error: %v\n", err)
+			return
+		}
+		if name == "" {
+			// nothing to check, try to send new packets
+			sd.offline = false
+			sd.sequences = make(map[string]uint64)
+			return
+		}
+		p, s := sd.unspool(name, b)
+		if p == nil {
+			continue
+		}
+		if err = sd.sendSpooled(name, p, s); err != nil {
+			loggerError.Printf("server is still offline: %v\n", err)
+		}
+		return
+	}
+}
+
+// drain sends spooled packets in order while the server is online.
+// A number of not acknowledged spooled packets is limited by spoolDrainLimit,
+// next ones are sent after acknowledgements, so the server isn't flooded.
+func (sd *sender) drain() {
+	if sd.spool == nil {
+		return
+	}
+	for !sd.offline && len(sd.inflight) < spoolDrainLimit {
+		name, b, err := sd.spool.next(sd.inflight)
+		if err != nil {
+			loggerError.Printf("spool error: %v\n", err)
+			return
+		}
+		if name == "" {
+			if len(sd.inflight) == 0 {
+				sd.sequences = make(map[string]uint64)
+			}
+			return
+		}
+		p, s := sd.unspool(name, b)
+		if p == nil {
+			continue
+		}
+		if err = sd.sendSpooled(name, p, s); err != nil {
+			// the packet will be sent again after server availability check
+			loggerError.Printf("server is offline, packets are spooled: %v\n", err)
+			sd.offline = true
+			return
+		}
+	}
+}
+
+// readAcks reads server acknowledgements and sends their sequence numbers to the channel.
+func readAcks(s *Server, clientID []byte, acks chan<- uint64) {
+	buf := make([]byte, packet.MaxDatagramSize)
+	for {
+		n, err := s.udpConn.Read(buf)
+		if err != nil {
+			if msg := err.Error(); strings.Contains(msg, "use of closed network connection") {
+				loggerInfo.Println(err)
+				return
+			}
+			loggerError.Println(err)
+			continue
+		}
+		a, err := packet.DecodeAck(buf[:n], s.publicKey)
+		if err != nil {
+			loggerError.Printf("invalid acknowledgement: %v\n", err)
+			continue
+		}
+		if !bytes.Equal(a.ClientID, clientID) {
+			loggerError.Printf("acknowledgement for unknown client %x\n", a.ClientID)
+			continue
+		}
+		acks <- a.Sequence
+	}
+}
+
+// consume handles services outputs and server acknowledgements.
+func consume(cfg *Config, co <-chan *packet.Packet, updates <-chan *update) {
+	sd := newSender(cfg, map[uint16]*Service{})
+	acks := make(chan uint64, cfg.Server.PendingLimit)
+	go readAcks(&cfg.Server, cfg.clientID, acks)
+
+	ticker := time.NewTicker(retryCheckPeriod)
+	defer ticker.Stop()
+	spoolTicker := time.NewTicker(spoolCheckPeriod)
+	defer spoolTicker.Stop()
+	for {
+		select {
+		case out, ok := <-co:
+			if !ok {
+				return
+			}
+			sd.handle(out)
+		case u := <-updates:
+			// pending packets keep their services settings
+			sd.services = u.services
+			sd.handle(u.registration)
+		case seq := <-acks:
+			sd.acknowledge(seq)
+		case t := <-ticker.C:
+			sd.retry(t)
+		case <-spoolTicker.C:
+			sd.check()
+			sd.drain()
+		}
+	}
+}
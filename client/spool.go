@@ -0,0 +1,174 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements client part of Meerkat project.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// spoolExt is an extension of spooled packets files.
+	spoolExt = ".pkt"
+)
+
+// Spool is disk-backed packets queue configuration.
+type Spool struct {
+	Dir     string `json:"dir"`
+	MaxSize int64  `json:"max_size"`
+	MaxAge  int    `json:"max_age"`
+}
+
+// spoolFile is an info about spooled packet file.
+type spoolFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// spool is disk-backed queue of encoded packets, files are named in order of adding.
+// Queue files are indexed in memory, the index is built once from the directory.
+// It isn't safe for concurrent use.
+type spool struct {
+	cfg     *Spool
+	counter int64
+	files   []spoolFile
+	size    int64
+}
+
+// newSpool returns new disk-backed queue or nil if it is not configured.
+func newSpool(cfg *Spool) (*spool, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+	// names are ordered between client restarts
+	sp := &spool{cfg: cfg, counter: time.Now().UnixNano()}
+	if err := sp.load(); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// load builds the index of spooled files from oldest to newest.
+func (sp *spool) load() error {
+	items, err := ioutil.ReadDir(sp.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.Mode().IsRegular() && strings.HasSuffix(item.Name(), spoolExt) {
+			sp.files = append(sp.files, spoolFile{name: item.Name(), size: item.Size(), modTime: item.ModTime()})
+			sp.size += item.Size()
+		}
+	}
+	return nil
+}
+
+// push adds new encoded packet to the end of the queue.
+func (sp *spool) push(b []byte) error {
+	sp.counter++
+	name := fmt.Sprintf("%020d%v", sp.counter, spoolExt)
+	fullName := filepath.Join(sp.cfg.Dir, name)
+	tmpName := fullName + ".tmp"
+	if err := ioutil.WriteFile(tmpName, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, fullName); err != nil {
+		return err
+	}
+	sp.files = append(sp.files, spoolFile{name: name, size: int64(len(b)), modTime: time.Now()})
+	sp.size += int64(len(b))
+	return sp.trim()
+}
+
+// trim removes expired files and the oldest ones if the queue exceeds its max size.
+func (sp *spool) trim() error {
+	expired := time.Now().Add(-time.Duration(sp.cfg.MaxAge) * time.Second)
+	for len(sp.files) > 0 {
+		f := sp.files[0]
+		tooOld := sp.cfg.MaxAge > 0 && f.modTime.Before(expired)
+		tooBig := sp.cfg.MaxSize > 0 && sp.size > sp.cfg.MaxSize
+		if !tooOld && !tooBig {
+			break
+		}
+		if err := sp.remove(f.name); err != nil {
+			return err
+		}
+		loggerError.Printf("spooled packet %v is dropped, expired=%v, overflow=%v\n", f.name, tooOld, tooBig)
+	}
+	return nil
+}
+
+// len returns a number of files in the queue.
+func (sp *spool) len() int {
+	return len(sp.files)
+}
+
+// next returns the name and content of the first file in the queue which is not skipped.
+// The name is empty if there are no such files.
+func (sp *spool) next(skip map[string]bool) (string, []byte, error) {
+	if err := sp.trim(); err != nil {
+		return "", nil, err
+	}
+	for i := 0; i < len(sp.files); {
+		name := sp.files[i].name
+		if skip[name] {
+			i++
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(sp.cfg.Dir, name))
+		if err == nil {
+			return name, b, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", nil, err
+		}
+		// the file was removed outside
+		if err = sp.remove(name); err != nil {
+			return "", nil, err
+		}
+	}
+	return "", nil, nil
+}
+
+// remove deletes the file from the queue.
+func (sp *spool) remove(name string) error {
+	if err := os.Remove(filepath.Join(sp.cfg.Dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := range sp.files {
+		if sp.files[i].name != name {
+			continue
+		}
+		sp.size -= sp.files[i].size
+		if i == 0 {
+			// usual case, the queue head is removed
+			sp.files = sp.files[1:]
+		} else {
+			sp.files = append(sp.files[:i], sp.files[i+1:]...)
+		}
+		break
+	}
+	return nil
+}
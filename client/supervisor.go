@@ -0,0 +1,109 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements client part of Meerkat project.
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+const (
+	// restartAlways is a policy to restart stopped worker in any case.
+	restartAlways = "always"
+	// restartOnFailure is a policy to restart worker stopped by an error.
+	restartOnFailure = "on-failure"
+	// restartNever is a policy to not restart stopped worker.
+	restartNever = "never"
+	// maxRestartDelay is max delay before worker restart,
+	// backoff is reset if the worker was running longer than it.
+	maxRestartDelay = 5 * time.Minute
+)
+
+// restartPolicies is known workers restart policies.
+var restartPolicies = map[string]bool{
+	restartAlways:    true,
+	restartOnFailure: true,
+	restartNever:     true,
+}
+
+// restart checks that the service worker should be restarted after its stop with err error.
+func (s *Service) restart(err error) bool {
+	switch s.Restart {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return err != nil
+	}
+	return false
+}
+
+// sendDown sends "worker down" event to the consumer.
+func sendDown(s *Service, serviceID uint16, packetSize int, err error, restart time.Duration, co chan<- *packet.Packet) {
+	result := &packet.Result{Status: packet.StatusDown, ExitCode: -1}
+	if err != nil {
+		result.Output = fmt.Sprintf("worker is stopped: %v", err)
+	} else {
+		result.Output = "worker is stopped"
+	}
+	if restart > 0 {
+		result.Output += fmt.Sprintf(", restart in %v", restart)
+	}
+	sendResult(s, serviceID, packetSize, result, co)
+}
+
+// stopped checks that the stop channel is closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// supervise runs service worker and restarts it by service's policy with exponential backoff.
+// It returns when the worker is not restarted or the stop channel is closed.
+func supervise(s *Service, serviceID uint16, worker workerFunc, packetSize int, co chan<- *packet.Packet, stop <-chan struct{}) {
+	delay := time.Duration(s.RestartDelay) * time.Second
+	for {
+		start := time.Now()
+		err := worker(s, serviceID, packetSize, co, stop)
+		if stopped(stop) {
+			return
+		}
+		loggerError.Printf("worker [%v] is stopped [restart=%v]: %v\n", s.Name, s.Restart, err)
+		if !s.restart(err) {
+			sendDown(s, serviceID, packetSize, err, 0, co)
+			return
+		}
+		if time.Since(start) > maxRestartDelay {
+			delay = time.Duration(s.RestartDelay) * time.Second
+		}
+		sendDown(s, serviceID, packetSize, err, delay, co)
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+		loggerInfo.Printf("restart worker [%v]\n", s.Name)
+	}
+}
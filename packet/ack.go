@@ -0,0 +1,74 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package packet implements client/server common part - packet settings/methods.
+package packet
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+const (
+	// ackHeaderSize is encoded acknowledgement size without signature:
+	// version (1), client ID (hashSize), sequence number (8).
+	ackHeaderSize = 1 + hashSize + 8
+)
+
+// Ack is server acknowledgement of received packet.
+// It is signed by server RSA private key.
+type Ack struct {
+	ClientID []byte
+	Sequence uint64
+}
+
+// EncodeAck encodes and signs the acknowledgement.
+func EncodeAck(a *Ack, privateKey *rsa.PrivateKey) ([]byte, error) {
+	if len(a.ClientID) != hashSize {
+		return nil, ErrClientID
+	}
+	b := make([]byte, ackHeaderSize, ackHeaderSize+privateKey.Size())
+	b[0] = Version
+	copy(b[1:1+hashSize], a.ClientID)
+	binary.LittleEndian.PutUint64(b[1+hashSize:ackHeaderSize], a.Sequence)
+	h := sha256.Sum256(b)
+	signature, err := rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, h[:], nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, signature...), nil
+}
+
+// DecodeAck decodes the acknowledgement and verifies its signature by server RSA public key.
+func DecodeAck(b []byte, publicKey *rsa.PublicKey) (*Ack, error) {
+	if len(b) != ackHeaderSize+publicKey.Size() {
+		return nil, ErrShortPacket
+	}
+	if b[0] != Version {
+		return nil, ErrVersion
+	}
+	h := sha256.Sum256(b[:ackHeaderSize])
+	if err := rsa.VerifyPSS(publicKey, crypto.SHA256, h[:], b[ackHeaderSize:], nil); err != nil {
+		return nil, ErrSignature
+	}
+	a := &Ack{
+		ClientID: b[1 : 1+hashSize],
+		Sequence: binary.LittleEndian.Uint64(b[1+hashSize : ackHeaderSize]),
+	}
+	return a, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package packet implements client/server common part - packet settings/methods.
+package packet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+const (
+	// sessionKeySize is AES-256 session key size.
+	sessionKeySize = 32
+	// nonceSize is AES-GCM standard nonce size.
+	nonceSize = 12
+	// tagSize is AES-GCM authentication tag size.
+	tagSize = 16
+)
+
+// ErrShortMessage is an error when encrypted message is shorter than its mandatory parts.
+var ErrShortMessage = errors.New("packet: short encrypted message")
+
+// SealOverhead returns encrypted message size overhead:
+// RSA-OAEP wrapped session key, AES-GCM nonce and tag.
+func SealOverhead(publicKey *rsa.PublicKey) int {
+	return publicKey.Size() + nonceSize + tagSize
+}
+
+// newGCM returns AES-GCM cipher for the session key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts data by new AES-GCM session key, the key is wrapped by RSA-OAEP.
+// Result format: wrapped key | nonce | ciphertext with tag.
+func Seal(publicKey *rsa.PublicKey, data []byte) ([]byte, error) {
+	key := make([]byte, sessionKeySize+nonceSize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	key, nonce := key[:sessionKeySize], key[sessionKeySize:]
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, SealOverhead(publicKey)+len(data))
+	b = append(b, wrapped...)
+	b = append(b, nonce...)
+	return aead.Seal(b, nonce, data, wrapped), nil
+}
+
+// Open decrypts data encrypted by Seal.
+func Open(privateKey *rsa.PrivateKey, data []byte) ([]byte, error) {
+	keySize := privateKey.Size()
+	if len(data) < keySize+nonceSize+tagSize {
+		return nil, ErrShortMessage
+	}
+	wrapped, nonce, ciphertext := data[:keySize], data[keySize:keySize+nonceSize], data[keySize+nonceSize:]
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, wrapped, nil)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, wrapped)
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package packet implements client/server common part - packet settings/methods.
+package packet
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxFragments is max number of fragments of one message.
+	MaxFragments = 256
+)
+
+// ErrTooLarge is an error when message payload needs more than MaxFragments fragments.
+var ErrTooLarge = errors.New("packet: message is too large")
+
+// Split splits packet payload to fragments with max size payload bytes.
+// All fragments have the same message ID.
+func Split(p *Packet, messageID uint32, size int) ([]*Packet, error) {
+	if size < 1 {
+		return nil, ErrFragment
+	}
+	count := (len(p.Payload) + size - 1) / size
+	if count == 0 {
+		// empty payload is sent as a single fragment
+		count = 1
+	}
+	if count > MaxFragments {
+		return nil, ErrTooLarge
+	}
+	fragments := make([]*Packet, count)
+	for i := range fragments {
+		start, end := i*size, (i+1)*size
+		if end > len(p.Payload) {
+			end = len(p.Payload)
+		}
+		fragments[i] = &Packet{
+			Flags:     p.Flags,
+			Format:    p.Format,
+			ServiceID: p.ServiceID,
+			MessageID: messageID,
+			Index:     uint16(i),
+			Count:     uint16(count),
+			Period:    p.Period,
+			Measured:  p.Measured,
+			ClientID:  p.ClientID,
+			Payload:   p.Payload[start:end],
+		}
+	}
+	return fragments, nil
+}
+
+// messageKey is an unique message identifier.
+type messageKey struct {
+	clientID  string
+	serviceID uint16
+	messageID uint32
+}
+
+// message is a partially received message.
+type message struct {
+	fragments [][]byte
+	received  int
+	updated   time.Time
+}
+
+// Assembler collects fragments and returns reassembled packets.
+// It is safe for concurrent use.
+type Assembler struct {
+	sync.Mutex
+	messages map[messageKey]*message
+}
+
+// NewAssembler returns new fragments assembler.
+func NewAssembler() *Assembler {
+	return &Assembler{messages: make(map[messageKey]*message)}
+}
+
+// Add adds new fragment p. It returns a full packet if all message fragments are received, otherwise nil.
+func (a *Assembler) Add(p *Packet) (*Packet, error) {
+	if p.Count == 0 || p.Index >= p.Count || p.Count > MaxFragments {
+		return nil, ErrFragment
+	}
+	if p.Count == 1 {
+		return p, nil
+	}
+	a.Lock()
+	defer a.Unlock()
+
+	key := messageKey{clientID: string(p.ClientID), serviceID: p.ServiceID, messageID: p.MessageID}
+	m, ok := a.messages[key]
+	if !ok {
+		m = &message{fragments: make([][]byte, p.Count)}
+		a.messages[key] = m
+	}
+	if len(m.fragments) != int(p.Count) {
+		return nil, ErrFragment
+	}
+	m.updated = time.Now()
+	if m.fragments[p.Index] != nil {
+		// duplicate fragment
+		return nil, nil
+	}
+	m.fragments[p.Index] = p.Payload
+	m.received++
+	if m.received < len(m.fragments) {
+		return nil, nil
+	}
+	delete(a.messages, key)
+
+	size := 0
+	for _, f := range m.fragments {
+		size += len(f)
+	}
+	payload := make([]byte, 0, size)
+	for _, f := range m.fragments {
+		payload = append(payload, f...)
+	}
+	result := &Packet{
+		Flags:     p.Flags,
+		Format:    p.Format,
+		ServiceID: p.ServiceID,
+		MessageID: p.MessageID,
+		Count:     1,
+		Period:    p.Period,
+		Timestamp: p.Timestamp,
+		Measured:  p.Measured,
+		Sequence:  p.Sequence,
+		ClientID:  p.ClientID,
+		Payload:   payload,
+	}
+	return result, nil
+}
+
+// Expire removes incomplete messages which were not updated since the time.
+// It returns the number of removed messages.
+func (a *Assembler) Expire(since time.Time) int {
+	a.Lock()
+	defer a.Unlock()
+
+	n := 0
+	for key, m := range a.messages {
+		if m.updated.Before(since) {
+			delete(a.messages, key)
+			n++
+		}
+	}
+	return n
+}
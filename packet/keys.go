@@ -0,0 +1,129 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package packet implements client/server common part - packet settings/methods.
+package packet
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// SignatureSize is Ed25519 packet signature size.
+	SignatureSize = ed25519.SignatureSize
+)
+
+var (
+	// ErrSignature is an error when packet has invalid signature.
+	ErrSignature = errors.New("packet: invalid signature")
+)
+
+// Sign signs the packet by client's private key.
+func Sign(p *Packet, privateKey ed25519.PrivateKey) error {
+	b, err := encodeBody(p)
+	if err != nil {
+		return err
+	}
+	p.Signature = ed25519.Sign(privateKey, b)
+	return nil
+}
+
+// Verify checks the packet signature by client's public key.
+func Verify(p *Packet, publicKey ed25519.PublicKey) error {
+	if len(p.Signature) != SignatureSize {
+		return ErrSignature
+	}
+	b, err := encodeBody(p)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, b, p.Signature) {
+		return ErrSignature
+	}
+	return nil
+}
+
+// GenSigningKeys generates and writes new Ed25519 keys pair.
+func GenSigningKeys(w io.Writer) error {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	privateBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	if err = pem.Encode(w, &pem.Block{Type: "PRIVATE KEY", Bytes: privateBytes}); err != nil {
+		return err
+	}
+	publicBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	return pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: publicBytes})
+}
+
+// readPEM reads the file and returns its PEM block with required type.
+func readPEM(name, blockType string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, errors.New("failed to decode PEM block containing " + blockType)
+	}
+	return block, nil
+}
+
+// ReadSigningKey reads Ed25519 private key from PEM file.
+func ReadSigningKey(name string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(name, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not Ed25519 private key")
+	}
+	return privateKey, nil
+}
+
+// ReadVerifyKey reads Ed25519 public key from PEM file.
+func ReadVerifyKey(name string) (ed25519.PublicKey, error) {
+	block, err := readPEM(name, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not Ed25519 public key")
+	}
+	return publicKey, nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package packet implements client/server common part - packet settings/methods.
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+const (
+	// FormatRaw is a payload format of opaque bytes.
+	FormatRaw uint8 = iota
+	// FormatMetrics is a payload format of encoded metrics.
+	FormatMetrics
+	// FormatResult is a payload format of encoded check result.
+	FormatResult
+	// FormatRegistration is a payload format of encoded client registration.
+	FormatRegistration
+)
+
+// ErrPayload is an error when structured payload can't be decoded.
+var ErrPayload = errors.New("packet: invalid payload")
+
+// Metric is a typed measurement value.
+type Metric struct {
+	Name      string
+	Value     float64
+	Unit      string
+	Labels    map[string]string
+	Timestamp int64 // nanoseconds since Unix epoch
+}
+
+// appendString appends length prefixed string.
+func appendString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendUvarint appends unsigned varint.
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// appendVarint appends signed varint.
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// EncodeMetrics encodes metrics to compact binary format:
+// count, then name, value, unit, timestamp and sorted labels of every metric.
+func EncodeMetrics(metrics []Metric) []byte {
+	return appendMetrics(nil, metrics)
+}
+
+// appendMetrics appends encoded metrics.
+func appendMetrics(b []byte, metrics []Metric) []byte {
+	b = appendUvarint(b, uint64(len(metrics)))
+	for i := range metrics {
+		m := &metrics[i]
+		b = appendString(b, m.Name)
+		var value [8]byte
+		binary.LittleEndian.PutUint64(value[:], math.Float64bits(m.Value))
+		b = append(b, value[:]...)
+		b = appendString(b, m.Unit)
+		b = appendVarint(b, m.Timestamp)
+
+		keys := make([]string, 0, len(m.Labels))
+		for k := range m.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendUvarint(b, uint64(len(keys)))
+		for _, k := range keys {
+			b = appendString(appendString(b, k), m.Labels[k])
+		}
+	}
+	return b
+}
+
+// payloadReader reads encoded payload values.
+type payloadReader struct {
+	b   []byte
+	err error
+}
+
+// uvarint reads unsigned varint.
+func (r *payloadReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = ErrPayload
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+// varint reads signed varint.
+func (r *payloadReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = ErrPayload
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+// string reads length prefixed string.
+func (r *payloadReader) string() string {
+	l := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if l > uint64(len(r.b)) {
+		r.err = ErrPayload
+		return ""
+	}
+	s := string(r.b[:l])
+	r.b = r.b[l:]
+	return s
+}
+
+// float reads float64 value.
+func (r *payloadReader) float() float64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) < 8 {
+		r.err = ErrPayload
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(r.b[:8]))
+	r.b = r.b[8:]
+	return v
+}
+
+// metrics reads encoded metrics.
+func (r *payloadReader) metrics() []Metric {
+	count := r.uvarint()
+	// every metric takes at least 12 bytes, it protects from huge allocations
+	if r.err != nil || count > uint64(len(r.b)/12) {
+		r.err = ErrPayload
+		return nil
+	}
+	metrics := make([]Metric, count)
+	for i := range metrics {
+		m := &metrics[i]
+		m.Name = r.string()
+		m.Value = r.float()
+		m.Unit = r.string()
+		m.Timestamp = r.varint()
+		n := r.uvarint()
+		if r.err != nil || n > uint64(len(r.b)/2) {
+			r.err = ErrPayload
+			return nil
+		}
+		if n > 0 {
+			m.Labels = make(map[string]string, n)
+			for j := uint64(0); j < n; j++ {
+				k := r.string()
+				m.Labels[k] = r.string()
+			}
+		}
+	}
+	return metrics
+}
+
+// end checks that all payload is read without errors.
+func (r *payloadReader) end() error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.b) > 0 {
+		return ErrPayload
+	}
+	return nil
+}
+
+// DecodeMetrics decodes metrics encoded by EncodeMetrics.
+func DecodeMetrics(b []byte) ([]Metric, error) {
+	r := &payloadReader{b: b}
+	metrics := r.metrics()
+	if err := r.end(); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
@@ -18,7 +18,9 @@ package packet
 
 import (
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
@@ -28,49 +30,141 @@ import (
 const (
 	// hashSize is SHA256 hash bytes size.
 	hashSize = 32
+	// Version is current packet format version,
+	// it is changed with every header or payload formats change to reject packets of incompatible peers.
+	Version = 3
+	// headerSize is encoded packet header size:
+	// version (1), flags (1), payload format (1), service ID (2), message ID (4), fragment index (2),
+	// fragments count (2), service period (4), timestamp (8), measurement time (8), sequence number (8),
+	// client ID (hashSize).
+	headerSize = 1 + 1 + 1 + 2 + 4 + 2 + 2 + 4 + 8 + 8 + 8 + hashSize
+	// FlagAck is a packet flag to request server acknowledgement.
+	FlagAck uint8 = 1 << 0
+	// MaxDatagramSize is max size of encrypted UDP datagram.
+	MaxDatagramSize = 8192
 	// InterruptPrefix is constant prefix of interrupt signal
 	InterruptPrefix = "interrupt signal"
 )
 
+var (
+	// ErrShortPacket is an error when encoded packet is shorter than its header.
+	ErrShortPacket = errors.New("packet: short packet")
+	// ErrVersion is an error when packet has unsupported version.
+	ErrVersion = errors.New("packet: unsupported version")
+	// ErrClientID is an error when packet has invalid client ID size.
+	ErrClientID = errors.New("packet: invalid client ID size")
+	// ErrFragment is an error when packet has invalid fragment index or count.
+	ErrFragment = errors.New("packet: invalid fragment")
+)
+
 // Packet is main packet structure.
 // Byte encoded packet cannot be bigger than MaxPacketPayloadSize().
 type Packet struct {
+	Flags     uint8  // 1 byte
+	Format    uint8  // 1 byte, payload format
 	ServiceID uint16 // 2 bytes
+	MessageID uint32 // 4 bytes
+	Index     uint16 // 2 bytes, fragment index
+	Count     uint16 // 2 bytes, fragments count
+	Period    uint32 // 4 bytes, service period in seconds
+	Timestamp int64  // 8 bytes, sending time in nanoseconds since Unix epoch
+	Measured  int64  // 8 bytes, measurement time in nanoseconds since Unix epoch
+	Sequence  uint64 // 8 bytes, client's monotonic sequence number
 	ClientID  []byte // hashSize bytes
 	Payload   []byte
+	Signature []byte // SignatureSize bytes
 }
 
+// ClientID returns client identifier by its name.
+func ClientID(name string) []byte {
+	id := sha256.Sum256([]byte(name))
+	return id[:]
+}
 
-// Encode encodes p Packet to byte slice.
-func Encode(p *Packet) []byte {
-	b := make([]byte, 2, len(p.Payload)+hashSize+2)
-	binary.LittleEndian.PutUint16(b, p.ServiceID)
-	b = append(b, p.ClientID...)
-	return append(b, p.Payload...)
+// encodeBody encodes p Packet to byte slice without signature.
+func encodeBody(p *Packet) ([]byte, error) {
+	if len(p.ClientID) != hashSize {
+		return nil, ErrClientID
+	}
+	if p.Count == 0 || p.Index >= p.Count {
+		return nil, ErrFragment
+	}
+	b := make([]byte, headerSize, headerSize+len(p.Payload)+SignatureSize)
+	b[0] = Version
+	b[1] = p.Flags
+	b[2] = p.Format
+	binary.LittleEndian.PutUint16(b[3:5], p.ServiceID)
+	binary.LittleEndian.PutUint32(b[5:9], p.MessageID)
+	binary.LittleEndian.PutUint16(b[9:11], p.Index)
+	binary.LittleEndian.PutUint16(b[11:13], p.Count)
+	binary.LittleEndian.PutUint32(b[13:17], p.Period)
+	binary.LittleEndian.PutUint64(b[17:25], uint64(p.Timestamp))
+	binary.LittleEndian.PutUint64(b[25:33], uint64(p.Measured))
+	binary.LittleEndian.PutUint64(b[33:41], p.Sequence)
+	copy(b[41:headerSize], p.ClientID)
+	return append(b, p.Payload...), nil
+}
+
+// Encode encodes signed p Packet to byte slice.
+func Encode(p *Packet) ([]byte, error) {
+	if len(p.Signature) != SignatureSize {
+		return nil, ErrSignature
+	}
+	b, err := encodeBody(p)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, p.Signature...), nil
 }
 
 // Decode decodes bytes to Packet struct.
-func Decode(b []byte) *Packet {
-	return &Packet{
-		ServiceID: binary.LittleEndian.Uint16(b[:2]),
-		ClientID:  b[2 : hashSize+2],
-		Payload:   b[hashSize+2:]}
+func Decode(b []byte) (*Packet, error) {
+	if len(b) < headerSize+SignatureSize {
+		return nil, ErrShortPacket
+	}
+	if b[0] != Version {
+		return nil, ErrVersion
+	}
+	signed := len(b) - SignatureSize
+	p := &Packet{
+		Flags:     b[1],
+		Format:    b[2],
+		ServiceID: binary.LittleEndian.Uint16(b[3:5]),
+		MessageID: binary.LittleEndian.Uint32(b[5:9]),
+		Index:     binary.LittleEndian.Uint16(b[9:11]),
+		Count:     binary.LittleEndian.Uint16(b[11:13]),
+		Period:    binary.LittleEndian.Uint32(b[13:17]),
+		Timestamp: int64(binary.LittleEndian.Uint64(b[17:25])),
+		Measured:  int64(binary.LittleEndian.Uint64(b[25:33])),
+		Sequence:  binary.LittleEndian.Uint64(b[33:41]),
+		ClientID:  b[41:headerSize],
+		Payload:   b[headerSize:signed],
+		Signature: b[signed:],
+	}
+	if p.Count == 0 || p.Index >= p.Count {
+		return nil, ErrFragment
+	}
+	return p, nil
 }
 
-// MaxPacketSize is max total packet size/
+// MaxPacketSize is max total encoded packet size, it is limited by datagram size and encryption overhead.
 func MaxPacketSize(publicKey *rsa.PublicKey) int {
-	return publicKey.N.BitLen() / 8
+	return MaxDatagramSize - SealOverhead(publicKey)
 }
 
-// MaxPacketPayloadSize calculates max UDP packet size.
+// MaxPacketPayloadSize calculates max packet payload size.
 func MaxPacketPayloadSize(publicKey *rsa.PublicKey) int {
-	// public exponent module size - 2*SHA256 - 2 - sizeof(Packet.ClientID) - sizeof(Packet.ServiceID)
-	return MaxPacketSize(publicKey) - 2*hashSize - 2 - hashSize - 2
+	return MaxPacketSize(publicKey) - headerSize - SignatureSize
+}
+
+// MaxMessageSize calculates max payload size which can be sent as fragments.
+func MaxMessageSize(publicKey *rsa.PublicKey) int {
+	return MaxFragments * MaxPacketPayloadSize(publicKey)
 }
 
 // Interrupt catches custom signals.
 func Interrupt(ec chan error) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	ec <- fmt.Errorf("%v %v", InterruptPrefix, <-c)
 }
@@ -0,0 +1,153 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package packet
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"reflect"
+	"testing"
+)
+
+// signedPacket returns new signed test packet.
+func signedPacket(t testing.TB) *Packet {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Packet{
+		Flags:     FlagAck,
+		Format:    FormatResult,
+		ServiceID: 513,
+		MessageID: 70000,
+		Index:     1,
+		Count:     3,
+		Period:    60,
+		Timestamp: 1500000000123456789,
+		Measured:  1500000000000000000,
+		Sequence:  42,
+		ClientID:  ClientID("test"),
+		Payload:   []byte("payload"),
+	}
+	if err = Sign(p, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestEncodeDecode(t *testing.T) {
+	p := signedPacket(t)
+	b, err := Encode(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(b); n != headerSize+len(p.Payload)+SignatureSize {
+		t.Errorf("invalid encoded size %v", n)
+	}
+	decoded, err := Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, decoded) {
+		t.Errorf("decoded packet %+v is not equal to %+v", decoded, p)
+	}
+	empty := signedPacket(t)
+	empty.Payload = nil
+	b, err = Encode(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Payload) != 0 {
+		t.Errorf("not empty payload %v", decoded.Payload)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(p *Packet)
+		err    error
+	}{
+		{name: "no signature", modify: func(p *Packet) { p.Signature = nil }, err: ErrSignature},
+		{name: "short signature", modify: func(p *Packet) { p.Signature = p.Signature[1:] }, err: ErrSignature},
+		{name: "short client ID", modify: func(p *Packet) { p.ClientID = p.ClientID[1:] }, err: ErrClientID},
+		{name: "no client ID", modify: func(p *Packet) { p.ClientID = nil }, err: ErrClientID},
+		{name: "zero count", modify: func(p *Packet) { p.Count = 0 }, err: ErrFragment},
+		{name: "index out of range", modify: func(p *Packet) { p.Index = p.Count }, err: ErrFragment},
+	}
+	for _, c := range cases {
+		p := signedPacket(t)
+		c.modify(p)
+		if _, err := Encode(p); err != c.err {
+			t.Errorf("%v: expected error %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	b, err := Encode(signedPacket(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		modify func(b []byte) []byte
+		err    error
+	}{
+		{name: "empty", modify: func(b []byte) []byte { return nil }, err: ErrShortPacket},
+		{name: "only header", modify: func(b []byte) []byte { return b[:headerSize] }, err: ErrShortPacket},
+		{name: "short signature", modify: func(b []byte) []byte { return b[:headerSize+SignatureSize-1] }, err: ErrShortPacket},
+		{name: "old version", modify: func(b []byte) []byte { b[0] = Version - 1; return b }, err: ErrVersion},
+		{name: "new version", modify: func(b []byte) []byte { b[0] = Version + 1; return b }, err: ErrVersion},
+		{name: "zero count", modify: func(b []byte) []byte { b[11], b[12] = 0, 0; return b }, err: ErrFragment},
+		{name: "index out of range", modify: func(b []byte) []byte { b[9], b[10] = b[11], b[12]; return b }, err: ErrFragment},
+	}
+	for _, c := range cases {
+		data := c.modify(append([]byte{}, b...))
+		if _, err := Decode(data); err != c.err {
+			t.Errorf("%v: expected error %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	b, err := Encode(signedPacket(f))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(b)
+	f.Add(b[:headerSize])
+	f.Add([]byte{})
+	f.Add(append([]byte{Version + 1}, b[1:]...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := Decode(data)
+		if err != nil {
+			return
+		}
+		encoded, err := Encode(p)
+		if err != nil {
+			t.Fatalf("decoded packet is not encoded: %v", err)
+		}
+		if !bytes.Equal(encoded, data) {
+			t.Fatalf("encoded packet %x is not equal to source %x", encoded, data)
+		}
+	})
+}
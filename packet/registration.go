@@ -0,0 +1,96 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package packet implements client/server common part - packet settings/methods.
+package packet
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// ControlServiceID is a reserved service ID of client's control messages.
+const ControlServiceID uint16 = 0
+
+// ServiceID returns service identifier by its name, it is never equal to ControlServiceID.
+func ServiceID(name string) uint16 {
+	h := sha256.Sum256([]byte(name))
+	id := binary.LittleEndian.Uint16(h[:2])
+	if id == ControlServiceID {
+		id++
+	}
+	return id
+}
+
+// ServiceInfo is a description of client's service.
+type ServiceInfo struct {
+	ID     uint16
+	Name   string
+	Type   string
+	Period uint32
+}
+
+// Registration is a client registration message with its host info and services.
+type Registration struct {
+	Hostname string
+	OS       string
+	Version  string
+	Revision string
+	Services []ServiceInfo
+}
+
+// EncodeRegistration encodes registration message to compact binary format:
+// hostname, OS, version, revision, services count, then ID, name, type and period of every service.
+func EncodeRegistration(reg *Registration) []byte {
+	b := appendString(nil, reg.Hostname)
+	b = appendString(b, reg.OS)
+	b = appendString(b, reg.Version)
+	b = appendString(b, reg.Revision)
+	b = appendUvarint(b, uint64(len(reg.Services)))
+	for _, s := range reg.Services {
+		b = appendUvarint(b, uint64(s.ID))
+		b = appendString(b, s.Name)
+		b = appendString(b, s.Type)
+		b = appendUvarint(b, uint64(s.Period))
+	}
+	return b
+}
+
+// DecodeRegistration decodes registration message encoded by EncodeRegistration.
+func DecodeRegistration(b []byte) (*Registration, error) {
+	r := &payloadReader{b: b}
+	reg := &Registration{Hostname: r.string(), OS: r.string(), Version: r.string(), Revision: r.string()}
+	count := r.uvarint()
+	// every service takes at least 4 bytes, it protects from huge allocations
+	if r.err != nil || count > uint64(len(r.b)/4) {
+		return nil, ErrPayload
+	}
+	reg.Services = make([]ServiceInfo, count)
+	for i := range reg.Services {
+		s := &reg.Services[i]
+		id := r.uvarint()
+		if id > uint64(^uint16(0)) {
+			return nil, ErrPayload
+		}
+		s.ID = uint16(id)
+		s.Name = r.string()
+		s.Type = r.string()
+		s.Period = uint32(r.uvarint())
+	}
+	if err := r.end(); err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
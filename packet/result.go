@@ -0,0 +1,86 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package packet implements client/server common part - packet settings/methods.
+package packet
+
+import (
+	"fmt"
+	"time"
+)
+
+// Check result statuses, first ones are compatible with Nagios plugins exit codes.
+const (
+	StatusOK uint8 = iota
+	StatusWarning
+	StatusCritical
+	StatusUnknown
+	StatusTimeout
+	StatusFailed
+	StatusDown
+)
+
+// statusNames is text names of check statuses.
+var statusNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN", "TIMEOUT", "FAILED", "DOWN"}
+
+// StatusName returns text name of the check status.
+func StatusName(status uint8) string {
+	if int(status) < len(statusNames) {
+		return statusNames[status]
+	}
+	return fmt.Sprintf("STATUS%d", status)
+}
+
+// Result is a service check result with its command execution details.
+type Result struct {
+	Status   uint8
+	Output   string
+	Metrics  []Metric
+	ExitCode int    // -1 if the command is not exited normally
+	Signal   string // signal name which terminated the command
+	Stderr   string
+	Duration time.Duration
+}
+
+// EncodeResult encodes check result to compact binary format:
+// status, output, metrics, exit code, signal, stderr and duration.
+func EncodeResult(result *Result) []byte {
+	b := []byte{result.Status}
+	b = appendString(b, result.Output)
+	b = appendMetrics(b, result.Metrics)
+	b = appendVarint(b, int64(result.ExitCode))
+	b = appendString(b, result.Signal)
+	b = appendString(b, result.Stderr)
+	return appendVarint(b, int64(result.Duration))
+}
+
+// DecodeResult decodes check result encoded by EncodeResult.
+func DecodeResult(b []byte) (*Result, error) {
+	if len(b) == 0 {
+		return nil, ErrPayload
+	}
+	r := &payloadReader{b: b[1:]}
+	result := &Result{Status: b[0]}
+	result.Output = r.string()
+	result.Metrics = r.metrics()
+	result.ExitCode = int(r.varint())
+	result.Signal = r.string()
+	result.Stderr = r.string()
+	result.Duration = time.Duration(r.varint())
+	if err := r.end(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
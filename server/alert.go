@@ -0,0 +1,100 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements server part of Meerkat project.
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// alertsCollection is MongoDB collection name for alerts.
+	alertsCollection = "alerts"
+	// alertFiring is a state of active alert.
+	alertFiring = "firing"
+	// alertResolved is a state of finished alert.
+	alertResolved = "resolved"
+	// alertStale is a kind of alert about missing service heartbeats.
+	alertStale = "stale"
+)
+
+// Alert is an alert about client's service.
+type Alert struct {
+	ID         bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	Key        string        `bson:"key" json:"key"`
+	Kind       string        `bson:"kind" json:"kind"`
+	State      string        `bson:"state" json:"state"`
+	ClientID   string        `bson:"client_id" json:"client_id"`
+	ClientName string        `bson:"client_name" json:"client_name"`
+	ServiceID  int           `bson:"service_id" json:"service_id"`
+	Service    string        `bson:"service_name,omitempty" json:"service_name,omitempty"`
+	Status     int           `bson:"status,omitempty" json:"status,omitempty"`
+	Message    string        `bson:"message" json:"message"`
+	Started    time.Time     `bson:"started" json:"started"`
+	Resolved   time.Time     `bson:"resolved,omitempty" json:"resolved,omitempty"`
+}
+
+// alertKey returns an unique key of alert condition.
+func alertKey(kind, clientID string, serviceID int, name string) string {
+	return fmt.Sprintf("%v:%v:%v:%v", kind, clientID, serviceID, name)
+}
+
+// SaveAlert inserts new firing alert or marks existing firing alert as resolved.
+func SaveAlert(ctx context.Context, a *Alert) error {
+	session, err := copySession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	coll := session.DB("").C(alertsCollection)
+	if a.State == alertFiring {
+		return coll.Insert(a)
+	}
+	update := bson.M{"$set": bson.M{"state": alertResolved, "resolved": a.Resolved}}
+	_, err = coll.UpdateAll(bson.M{"key": a.Key, "state": alertFiring}, update)
+	return err
+}
+
+// Alerts returns alerts with the state sorted by start time from newest.
+func Alerts(ctx context.Context, state string, limit int) ([]Alert, error) {
+	session, err := copySession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	result := []Alert{}
+	err = session.DB("").C(alertsCollection).Find(bson.M{"state": state}).Sort("-started").Limit(limit).All(&result)
+	return result, err
+}
+
+// raise logs, saves the alert and sends it to notifiers.
+func raise(ctx context.Context, d *dispatcher, a *Alert) {
+	if a.State == alertFiring {
+		loggerError.Printf("alert [%v] is firing: %v\n", a.Key, a.Message)
+	} else {
+		loggerInfo.Printf("alert [%v] is resolved: %v\n", a.Key, a.Message)
+	}
+	if err := SaveAlert(ctx, a); err != nil {
+		loggerError.Printf("alert [%v] saving error: %v\n", a.Key, err)
+	}
+	d.dispatch(a)
+}
@@ -18,6 +18,7 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -31,14 +32,28 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/z0rr0/meerkat/packet"
 	"gopkg.in/mgo.v2"
 )
 
 const (
 	dbSessionKey key = "db_session"
+	// defaultFragmentTimeout is default timeout in seconds to wait all message fragments.
+	defaultFragmentTimeout = 30
+	// defaultMaxSkew is default allowed difference in seconds between packet timestamp and server time.
+	defaultMaxSkew = 60
+	// defaultStalePeriods is default number of missed service periods to consider it as stale.
+	defaultStalePeriods = 3
+	// defaultKeyRotation is default period in seconds to accept packets encrypted for previous server key.
+	defaultKeyRotation = 86400
+	// defaultQueueSize is default max number of received datagrams waiting for handling.
+	defaultQueueSize = 1024
 )
 
 // key is internal type for context types.
@@ -72,17 +87,34 @@ type WebAdmin struct {
 
 // Server is main server configuration.
 type Server struct {
-	Host       string `json:"host"`
-	Port       int    `json:"port"`
-	PrivateKey string `json:"private_key"`
-	privateKey *rsa.PrivateKey
+	Host            string `json:"host"`
+	Port            int    `json:"port"`
+	PrivateKey      string `json:"private_key"`
+	FragmentTimeout int    `json:"fragment_timeout"`
+	MaxSkew         int    `json:"max_skew"`
+	StalePeriods    int    `json:"stale_periods"`
+	KeyRotation     int    `json:"key_rotation"`
+	Workers         int    `json:"workers"`
+	QueueSize       int    `json:"queue_size"`
+	privateKey      *rsa.PrivateKey
+}
+
+// Client is an allowed client info.
+type Client struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+	publicKey ed25519.PublicKey
 }
 
 // Config is main configuration info.
 type Config struct {
-	WebAdmin WebAdmin `json:"web_admin"`
-	Server   Server   `json:"server"`
-	Db       MongoCfg `json:"database"`
+	WebAdmin  WebAdmin      `json:"web_admin"`
+	Notifiers []NotifierCfg `json:"notifiers"`
+	Server    Server        `json:"server"`
+	Db        MongoCfg      `json:"database"`
+	Clients   []Client      `json:"clients"`
+	Rules     []Rule        `json:"rules"`
+	registry  map[string]*Client
 }
 
 // UDPAddr returns server udp address.
@@ -90,6 +122,17 @@ func (s *Server) UDPAddr() *net.UDPAddr {
 	return &net.UDPAddr{IP: net.ParseIP(s.Host), Port: s.Port}
 }
 
+// Addr returns web admin TCP address.
+func (w *WebAdmin) Addr() string {
+	return net.JoinHostPort(w.Host, fmt.Sprint(w.Port))
+}
+
+// Client returns allowed client by its ID.
+func (c *Config) Client(clientID []byte) (*Client, bool) {
+	client, ok := c.registry[string(clientID)]
+	return client, ok
+}
+
 // Addresses returns an array of available MongoDB connections addresses.
 func (cfg *MongoCfg) Addresses() []string {
 	hosts := make([]string, len(cfg.Hosts))
@@ -100,6 +143,13 @@ func (cfg *MongoCfg) Addresses() []string {
 	return hosts
 }
 
+// changed checks that connection settings are different.
+func (cfg *MongoCfg) changed(other *MongoCfg) bool {
+	a, b := *cfg, *other
+	a.MongoCred, a.Logger, b.MongoCred, b.Logger = nil, nil, nil, nil
+	return !reflect.DeepEqual(a, b)
+}
+
 func (cfg *MongoCfg) credential() error {
 	if cfg.Ssl {
 		pool := x509.NewCertPool()
@@ -187,17 +237,53 @@ func (c *Config) DbConnect(ctx context.Context) (context.Context, error) {
 	return CtxSetDBSession(ctx, session), nil
 }
 
+// DbReconnect sets new database connection and replaces the context session by it.
+func (c *Config) DbReconnect(ctx context.Context) error {
+	newCtx, err := c.DbConnect(context.Background())
+	if err != nil {
+		return err
+	}
+	session, err := CtxGetDBSession(newCtx, false)
+	if err != nil {
+		return err
+	}
+	return CtxReplaceDBSession(ctx, session)
+}
+
+// dbSession is a database session of the context, it can be replaced after reconnect.
+type dbSession struct {
+	sync.RWMutex
+	session *mgo.Session
+}
+
 // CtxSetDBSession saves db session object to the context.
 func CtxSetDBSession(ctx context.Context, s *mgo.Session) context.Context {
-	return context.WithValue(ctx, dbSessionKey, s)
+	return context.WithValue(ctx, dbSessionKey, &dbSession{session: s})
+}
+
+// CtxReplaceDBSession replaces db session of the context and closes the previous one.
+func CtxReplaceDBSession(ctx context.Context, s *mgo.Session) error {
+	ds, ok := ctx.Value(dbSessionKey).(*dbSession)
+	if !ok {
+		return errors.New("not found context db session")
+	}
+	ds.Lock()
+	old := ds.session
+	ds.session = s
+	ds.Unlock()
+	old.Close()
+	return nil
 }
 
 // CtxGetDBSession finds and returns MongoDB session from the Context.
 func CtxGetDBSession(ctx context.Context, sendPing bool) (*mgo.Session, error) {
-	s, ok := ctx.Value(dbSessionKey).(*mgo.Session)
+	ds, ok := ctx.Value(dbSessionKey).(*dbSession)
 	if !ok {
 		return nil, errors.New("not found context db session")
 	}
+	ds.RLock()
+	s := ds.session
+	ds.RUnlock()
 	if sendPing {
 		return s, s.Ping()
 	}
@@ -229,6 +315,24 @@ func Configuration(fileName string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Server.FragmentTimeout < 1 {
+		cfg.Server.FragmentTimeout = defaultFragmentTimeout
+	}
+	if cfg.Server.MaxSkew < 1 {
+		cfg.Server.MaxSkew = defaultMaxSkew
+	}
+	if cfg.Server.StalePeriods < 1 {
+		cfg.Server.StalePeriods = defaultStalePeriods
+	}
+	if cfg.Server.KeyRotation < 1 {
+		cfg.Server.KeyRotation = defaultKeyRotation
+	}
+	if cfg.Server.Workers < 1 {
+		cfg.Server.Workers = runtime.NumCPU()
+	}
+	if cfg.Server.QueueSize < 1 {
+		cfg.Server.QueueSize = defaultQueueSize
+	}
 	data, err := ioutil.ReadFile(cfg.Server.PrivateKey)
 	if err != nil {
 		return nil, err
@@ -242,6 +346,31 @@ func Configuration(fileName string) (*Config, error) {
 		return nil, err
 	}
 	cfg.Server.privateKey = key
+	cfg.registry = make(map[string]*Client, len(cfg.Clients))
+	for i := range cfg.Clients {
+		client := &cfg.Clients[i]
+		client.publicKey, err = packet.ReadVerifyKey(client.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("client %v key: %v", client.Name, err)
+		}
+		id := string(packet.ClientID(client.Name))
+		if _, ok := cfg.registry[id]; ok {
+			return nil, fmt.Errorf("duplicate client %v", client.Name)
+		}
+		cfg.registry[id] = client
+	}
+	// rule name is a part of its alerts keys
+	ruleNames := make(map[string]bool, len(cfg.Rules))
+	for i := range cfg.Rules {
+		rule := &cfg.Rules[i]
+		if err = rule.validate(); err != nil {
+			return nil, err
+		}
+		if ruleNames[rule.Name] {
+			return nil, fmt.Errorf("duplicate rule %v", rule.Name)
+		}
+		ruleNames[rule.Name] = true
+	}
 	return cfg, nil
 }
 
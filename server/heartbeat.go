@@ -0,0 +1,209 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements server part of Meerkat project.
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+const (
+	// heartbeatCheckPeriod is a period of stale services checking.
+	heartbeatCheckPeriod = time.Second
+)
+
+// serviceKey is an unique client's service identifier.
+type serviceKey struct {
+	clientID  string
+	serviceID uint16
+}
+
+// heartbeat is last-seen info of client's service.
+type heartbeat struct {
+	clientID   string
+	clientName string
+	serviceID  uint16
+	service    string
+	period     time.Duration
+	lastSeen   time.Time
+	stale      bool
+}
+
+// alert returns stale alert of the service with required state.
+func (h *heartbeat) alert(state string, t time.Time) *Alert {
+	a := &Alert{
+		Key:        alertKey(alertStale, h.clientID, int(h.serviceID), ""),
+		Kind:       alertStale,
+		State:      state,
+		ClientID:   h.clientID,
+		ClientName: h.clientName,
+		ServiceID:  int(h.serviceID),
+		Service:    h.service,
+		Started:    t,
+	}
+	if state == alertFiring {
+		a.Message = fmt.Sprintf("client %v service %v was last seen at %v", h.clientName, h.serviceID, h.lastSeen.Format(time.RFC3339))
+	} else {
+		a.Message = fmt.Sprintf("client %v service %v is active again", h.clientName, h.serviceID)
+		a.Resolved = t
+	}
+	return a
+}
+
+// heartbeats tracks services last-seen time and detects stale ones.
+// It is safe for concurrent use.
+type heartbeats struct {
+	sync.Mutex
+	periods int
+	items   map[serviceKey]*heartbeat
+}
+
+// newHeartbeats returns new heartbeats tracker,
+// service becomes stale if it misses periods number of its periods.
+func newHeartbeats(periods int) *heartbeats {
+	return &heartbeats{periods: periods, items: make(map[serviceKey]*heartbeat)}
+}
+
+// seen updates last-seen time of the packet service with registered name,
+// the time isn't moved back by concurrently handled packets.
+// It returns resolved alert if the service was stale.
+func (hs *heartbeats) seen(client *Client, p *packet.Packet, service string, t time.Time) *Alert {
+	hs.Lock()
+	defer hs.Unlock()
+
+	key := serviceKey{clientID: string(p.ClientID), serviceID: p.ServiceID}
+	h, ok := hs.items[key]
+	if !ok {
+		h = &heartbeat{clientID: hex.EncodeToString(p.ClientID), clientName: client.Name, serviceID: p.ServiceID}
+		hs.items[key] = h
+	}
+	h.service = service
+	h.period = time.Duration(p.Period) * time.Second
+	if t.After(h.lastSeen) {
+		h.lastSeen = t
+	}
+	if h.stale {
+		h.stale = false
+		return h.alert(alertResolved, t)
+	}
+	return nil
+}
+
+// setPeriods changes number of missed periods to consider service as stale.
+func (hs *heartbeats) setPeriods(periods int) {
+	hs.Lock()
+	defer hs.Unlock()
+	hs.periods = periods
+}
+
+// restore marks the service of firing stale alert as stale after server restart,
+// the alert is resolved when the service is seen again.
+func (hs *heartbeats) restore(a *Alert) error {
+	clientID, err := hex.DecodeString(a.ClientID)
+	if err != nil {
+		return err
+	}
+	hs.Lock()
+	defer hs.Unlock()
+
+	key := serviceKey{clientID: string(clientID), serviceID: uint16(a.ServiceID)}
+	hs.items[key] = &heartbeat{
+		clientID:   a.ClientID,
+		clientName: a.ClientName,
+		serviceID:  uint16(a.ServiceID),
+		service:    a.Service,
+		lastSeen:   a.Started,
+		stale:      true,
+	}
+	return nil
+}
+
+// track adds the registered service of the client to tracked ones after server restart,
+// so it becomes stale if it isn't seen again. Restored stale services get their period.
+func (hs *heartbeats) track(clientID, clientName string, s *RegisteredService, lastSeen time.Time) error {
+	rawID, err := hex.DecodeString(clientID)
+	if err != nil {
+		return err
+	}
+	hs.Lock()
+	defer hs.Unlock()
+
+	key := serviceKey{clientID: string(rawID), serviceID: uint16(s.ID)}
+	period := time.Duration(s.Period) * time.Second
+	if h, ok := hs.items[key]; ok {
+		if h.period == 0 {
+			h.period = period
+		}
+		return nil
+	}
+	hs.items[key] = &heartbeat{
+		clientID:   clientID,
+		clientName: clientName,
+		serviceID:  uint16(s.ID),
+		service:    s.Name,
+		period:     period,
+		lastSeen:   lastSeen,
+	}
+	return nil
+}
+
+// retain stops tracking client's services which are not registered anymore.
+// It returns resolved alerts of removed stale services.
+func (hs *heartbeats) retain(clientID []byte, services []RegisteredService, t time.Time) []*Alert {
+	registered := make(map[uint16]bool, len(services))
+	for _, s := range services {
+		registered[uint16(s.ID)] = true
+	}
+	hs.Lock()
+	defer hs.Unlock()
+
+	alerts := []*Alert{}
+	for key, h := range hs.items {
+		if key.clientID != string(clientID) || registered[key.serviceID] {
+			continue
+		}
+		delete(hs.items, key)
+		if h.stale {
+			a := h.alert(alertResolved, t)
+			a.Message = fmt.Sprintf("client %v service %v is removed", h.clientName, h.serviceID)
+			alerts = append(alerts, a)
+		}
+	}
+	return alerts
+}
+
+// check returns firing alerts of services which became stale.
+func (hs *heartbeats) check(now time.Time) []*Alert {
+	hs.Lock()
+	defer hs.Unlock()
+
+	alerts := []*Alert{}
+	for _, h := range hs.items {
+		if h.stale || h.period == 0 {
+			continue
+		}
+		if now.Sub(h.lastSeen) > h.period*time.Duration(hs.periods) {
+			h.stale = true
+			alerts = append(alerts, h.alert(alertFiring, now))
+		}
+	}
+	return alerts
+}
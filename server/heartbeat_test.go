@@ -0,0 +1,94 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+func TestHeartbeatsTrack(t *testing.T) {
+	now := time.Now().UTC()
+	rawID := []byte("client")
+	clientID := hex.EncodeToString(rawID)
+	hs := newHeartbeats(2)
+
+	restored := &Alert{ClientID: clientID, ClientName: "c", ServiceID: 2, Service: "b", Started: now}
+	if err := hs.restore(restored); err != nil {
+		t.Fatal(err)
+	}
+	services := []RegisteredService{{ID: 1, Name: "a", Period: 10}, {ID: 2, Name: "b", Period: 20}}
+	for i := range services {
+		if err := hs.track(clientID, "c", &services[i], now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := hs.track("invalid", "c", &services[0], now); err == nil {
+		t.Error("expected error")
+	}
+	if h := hs.items[serviceKey{clientID: string(rawID), serviceID: 2}]; !h.stale || h.period != 20*time.Second {
+		t.Errorf("unexpected restored heartbeat %+v", h)
+	}
+	if alerts := hs.check(now.Add(15 * time.Second)); len(alerts) != 0 {
+		t.Errorf("unexpected alerts %v", len(alerts))
+	}
+	alerts := hs.check(now.Add(25 * time.Second))
+	if len(alerts) != 1 {
+		t.Fatalf("unexpected alerts %v", len(alerts))
+	}
+	if a := alerts[0]; a.State != alertFiring || a.ServiceID != 1 || a.Service != "a" || a.ClientID != clientID {
+		t.Errorf("unexpected alert %+v", a)
+	}
+	p := &packet.Packet{ClientID: rawID, ServiceID: 1, Period: 10}
+	if a := hs.seen(&Client{Name: "c"}, p, "a", now.Add(30*time.Second)); a == nil || a.State != alertResolved {
+		t.Errorf("unexpected alert %+v", a)
+	}
+}
+
+func TestHeartbeatsRetain(t *testing.T) {
+	now := time.Now().UTC()
+	hs := newHeartbeats(2)
+	client := &Client{Name: "c"}
+	for _, p := range []*packet.Packet{
+		{ClientID: []byte("client"), ServiceID: 1, Period: 10},
+		{ClientID: []byte("client"), ServiceID: 2, Period: 10},
+		{ClientID: []byte("client"), ServiceID: 3, Period: 10},
+		{ClientID: []byte("other"), ServiceID: 2, Period: 10},
+	} {
+		hs.seen(client, p, "s", now)
+	}
+	if alerts := hs.check(now.Add(30 * time.Second)); len(alerts) != 4 {
+		t.Fatalf("unexpected alerts %v", len(alerts))
+	}
+	alerts := hs.retain([]byte("client"), []RegisteredService{{ID: 1}}, now.Add(40*time.Second))
+	if len(alerts) != 2 {
+		t.Fatalf("unexpected alerts %v", len(alerts))
+	}
+	for _, a := range alerts {
+		if a.State != alertResolved || a.ServiceID == 1 {
+			t.Errorf("unexpected alert %+v", a)
+		}
+	}
+	if n := len(hs.items); n != 2 {
+		t.Errorf("unexpected heartbeats %v", n)
+	}
+	if _, ok := hs.items[serviceKey{clientID: "other", serviceID: 2}]; !ok {
+		t.Error("other client's service is removed")
+	}
+}
@@ -17,58 +17,370 @@
 package main
 
 import (
-	"crypto/rand"
+	"context"
 	"crypto/rsa"
-	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/z0rr0/meerkat/packet"
 )
 
-func receive(privateKey *rsa.PrivateKey, msg []byte) error {
-	b, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, msg, nil)
+// datagram is a raw incoming UDP message.
+type datagram struct {
+	buf  []byte
+	data []byte
+	addr *net.UDPAddr
+}
+
+// datagrams is a pool of incoming messages buffers.
+var datagrams = sync.Pool{
+	New: func() interface{} {
+		return &datagram{buf: make([]byte, packet.MaxDatagramSize)}
+	},
+}
+
+// receiver handles incoming datagrams, it is safe for concurrent use.
+// Configuration and notifications dispatcher are protected by the mutex, they are replaced after reload.
+type receiver struct {
+	sync.RWMutex
+	cfg        *Config
+	conn       *net.UDPConn
+	keys       *keyring
+	assembler  *packet.Assembler
+	replay     *replayFilter
+	heartbeats *heartbeats
+	rules      *rulesEngine
+	statuses   *statuses
+	names      *serviceNames
+	dispatcher *dispatcher
+	// released are previous dispatchers which are stopped after reload
+	released sync.WaitGroup
+}
+
+// newReceiver returns new incoming datagrams handler.
+func newReceiver(cfg *Config, conn *net.UDPConn, d *dispatcher) *receiver {
+	return &receiver{
+		cfg:        cfg,
+		conn:       conn,
+		keys:       newKeyring(cfg.Server.privateKey),
+		assembler:  packet.NewAssembler(),
+		replay:     newReplayFilter(time.Duration(cfg.Server.MaxSkew) * time.Second),
+		heartbeats: newHeartbeats(cfg.Server.StalePeriods),
+		rules:      newRulesEngine(cfg.Rules),
+		statuses:   newStatuses(),
+		names:      newServiceNames(),
+		dispatcher: d,
+	}
+}
+
+// decode decrypts, decodes and verifies incoming datagram.
+// It also returns server private key which was used for decryption.
+func (rc *receiver) decode(d *datagram) (*packet.Packet, *Client, *rsa.PrivateKey, error) {
+	b, key, err := rc.keys.open(d.data, time.Now())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p, err := packet.Decode(b)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	client, ok := rc.cfg.Client(p.ClientID)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("unknown client %x from %v", p.ClientID, d.addr)
+	}
+	if err = packet.Verify(p, client.publicKey); err != nil {
+		return nil, nil, nil, fmt.Errorf("client %v from %v: %v", client.Name, d.addr, err)
+	}
+	return p, client, key, nil
+}
+
+// ack sends acknowledgement of the packet to its client,
+// it is signed by the same key which the client used for encryption.
+func (rc *receiver) ack(p *packet.Packet, key *rsa.PrivateKey, addr *net.UDPAddr) error {
+	b, err := packet.EncodeAck(&packet.Ack{ClientID: p.ClientID, Sequence: p.Sequence}, key)
+	if err != nil {
+		return err
+	}
+	_, err = rc.conn.WriteToUDP(b, addr)
+	return err
+}
+
+// receive handles incoming datagram and sends its acknowledgement if it is requested.
+func (rc *receiver) receive(ctx context.Context, d *datagram) error {
+	rc.RLock()
+	defer rc.RUnlock()
+
+	atomic.AddUint64(&counters.Received, 1)
+	p, client, key, err := rc.decode(d)
+	if err != nil {
+		atomic.AddUint64(&counters.Invalid, 1)
+		return err
+	}
+	now := time.Now()
+	if err = rc.replay.check(p, now); err != nil {
+		if err == errDuplicate && p.Flags&packet.FlagAck != 0 {
+			// retransmitted packet, its acknowledgement was lost
+			loggerInfo.Printf("client %v from %v: packet %v is acknowledged again\n", client.Name, d.addr, p.Sequence)
+			return rc.ack(p, key, d.addr)
+		}
+		return fmt.Errorf("client %v from %v: %v", client.Name, d.addr, err)
+	}
+	if p.ServiceID != packet.ControlServiceID {
+		service := rc.names.name(hex.EncodeToString(p.ClientID), p.ServiceID)
+		if a := rc.heartbeats.seen(client, p, service, now.UTC()); a != nil {
+			raise(ctx, rc.dispatcher, a)
+		}
+	}
+	err = rc.handle(ctx, client, p, d.addr)
+	// failed packet is not acknowledged, its retransmission will be handled again
+	rc.replay.done(p, err == nil)
 	if err != nil {
 		return err
 	}
-	p := packet.Decode(b)
-	loggerInfo.Printf("receive from %v data\n%v\n", p.ServiceID, string(p.Payload))
+	if p.Flags&packet.FlagAck != 0 {
+		return rc.ack(p, key, d.addr)
+	}
 	return nil
 }
 
-// listen reads data from UDP socket
-func listen(udpConn *net.UDPConn, privateKey *rsa.PrivateKey, wg *sync.WaitGroup, stop chan bool) {
-	wg.Add(1)
+// handle saves the packet to the database when all fragments of its message are received.
+func (rc *receiver) handle(ctx context.Context, client *Client, p *packet.Packet, addr *net.UDPAddr) error {
+	p, err := rc.assembler.Add(p)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		// wait other fragments
+		return nil
+	}
+	if p.Format == packet.FormatRegistration {
+		return rc.register(ctx, client, p, addr)
+	}
+	r, err := NewRecord(p, addr.String())
+	if err != nil {
+		return fmt.Errorf("client %v service %v: %v", client.Name, p.ServiceID, err)
+	}
+	r.Service = rc.names.name(r.ClientID, p.ServiceID)
+	loggerInfo.Printf("receive from %v [%v] data\n%v\n", client.Name, p.ServiceID, r.Text())
+	if err = SaveRecord(ctx, r); err != nil {
+		return err
+	}
+	for _, a := range rc.rules.evaluate(client, r, r.Received) {
+		raise(ctx, rc.dispatcher, a)
+	}
+	for _, a := range rc.statuses.update(client, r, r.Received) {
+		raise(ctx, rc.dispatcher, a)
+	}
+	return TrackClient(ctx, client.Name, r)
+}
+
+// register saves client's services registration.
+func (rc *receiver) register(ctx context.Context, client *Client, p *packet.Packet, addr *net.UDPAddr) error {
+	reg, err := packet.DecodeRegistration(p.Payload)
+	if err != nil {
+		return fmt.Errorf("client %v registration: %v", client.Name, err)
+	}
+	clientID, services := hex.EncodeToString(p.ClientID), newRegisteredServices(reg)
+	rc.names.set(clientID, services)
+	for _, a := range rc.heartbeats.retain(p.ClientID, services, time.Now().UTC()) {
+		raise(ctx, rc.dispatcher, a)
+	}
+	loggerInfo.Printf("client %v [%v %v %v] from %v is registered with %v services\n",
+		client.Name, reg.Hostname, reg.OS, reg.Version, addr, len(services))
+	return RegisterClient(ctx, client.Name, clientID, addr.String(), newHost(reg), services, time.Now().UTC())
+}
+
+// read reads datagrams from UDP socket to the queue until stop channel is closed.
+// Backpressure policy is drop-when-full: the queue is bounded and a new datagram is dropped
+// if the queue is full, so slow handling doesn't exhaust the memory and socket reading isn't blocked.
+// Clients retransmit dropped packets which require acknowledgement.
+// Dropped datagrams and queue depth are reported by server metrics.
+// It closes the queue before return.
+func read(udpConn *net.UDPConn, queue chan<- *datagram, stop <-chan bool) {
+	defer close(queue)
+	for {
+		d := datagrams.Get().(*datagram)
+		n, addr, err := udpConn.ReadFromUDP(d.buf)
+		if err != nil {
+			datagrams.Put(d)
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if msg := err.Error(); strings.Contains(msg, "use of closed network connection") {
+				loggerInfo.Println(err)
+				return
+			}
+			loggerError.Println(err)
+			continue
+		}
+		d.data, d.addr = d.buf[:n], addr
+		atomic.AddInt64(&counters.Queued, 1)
+		select {
+		case queue <- d:
+		default:
+			atomic.AddInt64(&counters.Queued, -1)
+			atomic.AddUint64(&counters.Dropped, 1)
+			datagrams.Put(d)
+		}
+	}
+}
+
+// work handles datagrams from the queue until it is closed.
+func (rc *receiver) work(ctx context.Context, queue <-chan *datagram, wg *sync.WaitGroup) {
 	defer wg.Done()
+	for d := range queue {
+		atomic.AddInt64(&counters.Queued, -1)
+		if err := rc.receive(ctx, d); err != nil {
+			loggerError.Printf("error during message decoding: %v\n", err)
+		}
+		datagrams.Put(d)
+	}
+}
 
-	buf := make([]byte, packet.MaxPacketSize(&privateKey.PublicKey))
-	bc := make(chan []byte)
-	go func() {
-		for {
-			n, addr, err := udpConn.ReadFromUDP(buf[:])
-			if err != nil {
-				if msg := err.Error(); strings.Contains(msg, "use of closed network connection") {
-					loggerInfo.Println(err)
-					close(bc)
-					return
-				}
-				loggerError.Println(err)
+// restore loads firing alerts, so they are resolved and not fired again after server restart.
+func (rc *receiver) restore(ctx context.Context) error {
+	alerts, err := Alerts(ctx, alertFiring, 0)
+	if err != nil {
+		return err
+	}
+	for i := range alerts {
+		a := &alerts[i]
+		switch a.Kind {
+		case alertStale:
+			if err = rc.heartbeats.restore(a); err != nil {
+				loggerError.Printf("alert [%v] restoring error: %v\n", a.Key, err)
 			}
-			loggerInfo.Printf("read %v bytes from %v\n", n, addr)
-			bc <- buf[:n]
+		case alertRule:
+			rc.rules.restore(a)
+		case alertStatus:
+			rc.statuses.restore(a)
+		}
+	}
+	loggerInfo.Printf("%v firing alerts are restored\n", len(alerts))
+	return nil
+}
+
+// seed tracks heartbeats of registered services after server restart,
+// their last-seen time is the latest record time, server downtime isn't counted,
+// so services which don't send data after restart become stale.
+func (rc *receiver) seed(ctx context.Context, started time.Time) error {
+	clients, err := Clients(ctx)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, c := range clients {
+		if len(c.Registered) == 0 {
+			continue
+		}
+		services, err := Services(ctx, c.ClientID)
+		if err != nil {
+			return err
 		}
+		lastSeen := make(map[int]time.Time, len(services))
+		for _, s := range services {
+			lastSeen[s.ServiceID] = s.LastSeen
+		}
+		for i := range c.Registered {
+			s := &c.Registered[i]
+			if s.ID == int(packet.ControlServiceID) || s.Period == 0 {
+				continue
+			}
+			t, ok := lastSeen[s.ID]
+			if !ok {
+				t = c.RegisteredAt
+			}
+			if t.Before(started) {
+				t = started
+			}
+			if err = rc.heartbeats.track(c.ClientID, c.Name, s, t); err != nil {
+				loggerError.Printf("client %v service %v tracking error: %v\n", c.Name, s.ID, err)
+				continue
+			}
+			n++
+		}
+	}
+	loggerInfo.Printf("%v registered services are tracked\n", n)
+	return nil
+}
+
+// listen reads data from UDP socket and handles it by a pool of workers,
+// configuration is reloaded after a signal from the reload channel.
+// It stops the current notifications dispatcher and waits previous ones before return.
+func listen(ctx context.Context, udpConn *net.UDPConn, cfg *Config, d *dispatcher, fileName string,
+	reload <-chan os.Signal, wg *sync.WaitGroup, stop chan bool) {
+	wg.Add(1)
+	defer wg.Done()
+
+	rc := newReceiver(cfg, udpConn, d)
+	defer func() {
+		rc.dispatcher.stop()
+		rc.released.Wait()
+	}()
+	if err := rc.names.load(ctx); err != nil {
+		loggerError.Printf("services names loading error: %v\n", err)
+	}
+	if err := rc.restore(ctx); err != nil {
+		loggerError.Printf("alerts restoring error: %v\n", err)
+	}
+	if err := rc.seed(ctx, time.Now().UTC()); err != nil {
+		loggerError.Printf("heartbeats seeding error: %v\n", err)
+	}
+	fragmentTimeout := time.Duration(cfg.Server.FragmentTimeout) * time.Second
+	ticker := time.NewTicker(fragmentTimeout)
+	defer func() {
+		ticker.Stop()
 	}()
+	heartbeatTicker := time.NewTicker(heartbeatCheckPeriod)
+	defer heartbeatTicker.Stop()
+
+	var workers sync.WaitGroup
+	queue := make(chan *datagram, cfg.Server.QueueSize)
+	go read(udpConn, queue, stop)
+	for i := 0; i < cfg.Server.Workers; i++ {
+		workers.Add(1)
+		go rc.work(ctx, queue, &workers)
+	}
+	loggerInfo.Printf("started %v workers, queue size %v\n", cfg.Server.Workers, cfg.Server.QueueSize)
 
 	for {
 		select {
 		case <-stop:
+			// interrupt socket reading, workers handle queued datagrams
+			if err := udpConn.SetReadDeadline(time.Now()); err != nil {
+				loggerError.Println(err)
+			}
+			workers.Wait()
 			return
-		case b := <-bc:
-			// handled incoming data
-			if err := receive(privateKey, b); err != nil {
-				loggerError.Printf("error during message decoding: %v\n", err)
+		case <-reload:
+			if err := rc.reload(ctx, fileName); err != nil {
+				loggerError.Printf("configuration reload error: %v\n", err)
+				continue
+			}
+			loggerInfo.Println("configuration is reloaded")
+			if timeout := time.Duration(rc.cfg.Server.FragmentTimeout) * time.Second; timeout != fragmentTimeout {
+				fragmentTimeout = timeout
+				ticker.Stop()
+				ticker = time.NewTicker(fragmentTimeout)
+			}
+		case t := <-ticker.C:
+			if n := rc.assembler.Expire(t.Add(-fragmentTimeout)); n > 0 {
+				loggerError.Printf("%v incomplete messages are expired\n", n)
+			}
+		case t := <-heartbeatTicker.C:
+			rc.RLock()
+			for _, a := range rc.heartbeats.check(t.UTC()) {
+				raise(ctx, rc.dispatcher, a)
 			}
+			rc.RUnlock()
 		}
 	}
 }
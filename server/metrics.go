@@ -0,0 +1,47 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements server part of Meerkat project.
+package main
+
+import (
+	"sync/atomic"
+)
+
+// counters is global server metrics.
+var counters = &Metrics{}
+
+// Metrics is server packets counters and incoming queue depth.
+// Fields must be updated and read atomically.
+type Metrics struct {
+	Received  uint64 `json:"received"`
+	Invalid   uint64 `json:"invalid"`
+	Stale     uint64 `json:"stale"`
+	Duplicate uint64 `json:"duplicate"`
+	Dropped   uint64 `json:"dropped"`
+	Queued    int64  `json:"queued"`
+}
+
+// Snapshot returns a copy of current metrics values.
+func (m *Metrics) Snapshot() *Metrics {
+	return &Metrics{
+		Received:  atomic.LoadUint64(&m.Received),
+		Invalid:   atomic.LoadUint64(&m.Invalid),
+		Stale:     atomic.LoadUint64(&m.Stale),
+		Duplicate: atomic.LoadUint64(&m.Duplicate),
+		Dropped:   atomic.LoadUint64(&m.Dropped),
+		Queued:    atomic.LoadInt64(&m.Queued),
+	}
+}
@@ -0,0 +1,398 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements server part of Meerkat project.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	// notifyQueueSize is max number of alerts waiting for notification.
+	notifyQueueSize = 256
+	// defaultNotifyTimeout is default notification timeout in seconds.
+	defaultNotifyTimeout = 10
+	// defaultRetryDelay is default initial delay in seconds before notification retry.
+	defaultRetryDelay = 1
+)
+
+// Notifier delivers alerts.
+type Notifier interface {
+	Notify(ctx context.Context, a *Alert) error
+}
+
+// NotifierCfg is alerts notifier configuration.
+type NotifierCfg struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	URL        string   `json:"url"`
+	Host       string   `json:"host"`
+	Port       uint     `json:"port"`
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	From       string   `json:"from"`
+	To         []string `json:"to"`
+	Exec       string   `json:"exec"`
+	Args       []string `json:"args"`
+	Timeout    int      `json:"timeout"`
+	Retries    int      `json:"retries"`
+	RetryDelay int      `json:"retry_delay"`
+	RateLimit  int      `json:"rate_limit"`
+	Dedup      int      `json:"dedup"`
+}
+
+// notifiersMap is notifiers constructors by their types.
+var notifiersMap = map[string]func(*NotifierCfg) (Notifier, error){
+	"webhook": newWebhookNotifier,
+	"smtp":    newSMTPNotifier,
+	"exec":    newExecNotifier,
+}
+
+// alertSubject returns short alert description.
+func alertSubject(a *Alert) string {
+	service := fmt.Sprint(a.ServiceID)
+	if a.Service != "" {
+		service = a.Service
+	}
+	return fmt.Sprintf("[Meerkat] %v %v alert: %v service %v", a.State, a.Kind, a.ClientName, service)
+}
+
+// webhookNotifier sends alerts as JSON by HTTP POST request.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// newWebhookNotifier returns new webhook notifier.
+func newWebhookNotifier(cfg *NotifierCfg) (Notifier, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("notifier %v: url is required", cfg.Name)
+	}
+	return &webhookNotifier{url: cfg.URL, client: &http.Client{}}, nil
+}
+
+// Notify sends the alert.
+func (n *webhookNotifier) Notify(ctx context.Context, a *Alert) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook response status %v", resp.Status)
+	}
+	return nil
+}
+
+// smtpNotifier sends alerts by email.
+type smtpNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+// newSMTPNotifier returns new email notifier.
+func newSMTPNotifier(cfg *NotifierCfg) (Notifier, error) {
+	if cfg.Host == "" || cfg.From == "" || len(cfg.To) == 0 {
+		return nil, fmt.Errorf("notifier %v: host, from and to are required", cfg.Name)
+	}
+	n := &smtpNotifier{addr: net.JoinHostPort(cfg.Host, fmt.Sprint(cfg.Port)), from: cfg.From, to: cfg.To}
+	if cfg.Username != "" {
+		n.auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	return n, nil
+}
+
+// Notify sends the alert.
+func (n *smtpNotifier) Notify(ctx context.Context, a *Alert) error {
+	msg := fmt.Sprintf(
+		"From: %v\r\nTo: %v\r\nSubject: %v\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%v\r\nStarted: %v\r\n",
+		n.from, strings.Join(n.to, ", "), alertSubject(a), a.Message, a.Started.Format(time.RFC3339),
+	)
+	if a.State == alertResolved {
+		msg += fmt.Sprintf("Resolved: %v\r\n", a.Resolved.Format(time.RFC3339))
+	}
+	ec := make(chan error, 1)
+	go func() {
+		ec <- smtp.SendMail(n.addr, n.auth, n.from, n.to, []byte(msg))
+	}()
+	select {
+	case err := <-ec:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// execNotifier runs local command for alerts, the alert is passed as JSON to stdin.
+type execNotifier struct {
+	exec string
+	args []string
+}
+
+// newExecNotifier returns new command notifier.
+func newExecNotifier(cfg *NotifierCfg) (Notifier, error) {
+	if cfg.Exec == "" {
+		return nil, fmt.Errorf("notifier %v: exec is required", cfg.Name)
+	}
+	return &execNotifier{exec: cfg.Exec, args: cfg.Args}, nil
+}
+
+// Notify runs the command.
+func (n *execNotifier) Notify(ctx context.Context, a *Alert) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, n.exec, n.args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(),
+		"MEERKAT_ALERT_KEY="+a.Key,
+		"MEERKAT_ALERT_KIND="+a.Kind,
+		"MEERKAT_ALERT_STATE="+a.State,
+		"MEERKAT_ALERT_CLIENT="+a.ClientName,
+		fmt.Sprintf("MEERKAT_ALERT_SERVICE=%v", a.ServiceID),
+		"MEERKAT_ALERT_SERVICE_NAME="+a.Service,
+		"MEERKAT_ALERT_MESSAGE="+a.Message,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("command error: %v, output: %v", err, string(out))
+	}
+	return nil
+}
+
+// sentAlert is the last sent state of alert.
+type sentAlert struct {
+	state string
+	time  time.Time
+}
+
+// notifier delivers alerts by its implementation with deduplication, rate limiting and retries.
+type notifier struct {
+	cfg     *NotifierCfg
+	impl    Notifier
+	queue   chan *Alert
+	sent    map[string]sentAlert
+	history []time.Time
+	done    chan struct{}
+}
+
+// duplicate checks that the alert state is the same as the last delivered one during deduplication period.
+func (n *notifier) duplicate(a *Alert, now time.Time) bool {
+	window := time.Duration(n.cfg.Dedup) * time.Second
+	for key, s := range n.sent {
+		if now.Sub(s.time) >= window {
+			delete(n.sent, key)
+		}
+	}
+	s, ok := n.sent[a.Key]
+	return ok && s.state == a.State
+}
+
+// delivered saves the alert state for deduplication.
+func (n *notifier) delivered(a *Alert, now time.Time) {
+	if n.cfg.Dedup > 0 {
+		n.sent[a.Key] = sentAlert{state: a.State, time: now}
+	}
+}
+
+// limited checks that notifications number per minute is exceeded.
+func (n *notifier) limited(now time.Time) bool {
+	if n.cfg.RateLimit < 1 {
+		return false
+	}
+	i, minute := 0, now.Add(-time.Minute)
+	for i < len(n.history) && n.history[i].Before(minute) {
+		i++
+	}
+	n.history = n.history[i:]
+	return len(n.history) >= n.cfg.RateLimit
+}
+
+// count adds the notification to rate limit history.
+func (n *notifier) count(now time.Time) {
+	if n.cfg.RateLimit > 0 {
+		n.history = append(n.history, now)
+	}
+}
+
+// send delivers the alert, failed notifications are retried with exponential backoff.
+func (n *notifier) send(a *Alert) error {
+	var err error
+	delay := time.Duration(n.cfg.RetryDelay) * time.Second
+	for attempt := 0; attempt <= n.cfg.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.cfg.Timeout)*time.Second)
+		err = n.impl.Notify(ctx, a)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		loggerError.Printf("notifier [%v] attempt %v failed: %v\n", n.cfg.Name, attempt+1, err)
+	}
+	return err
+}
+
+// run handles notifier queue until it is closed.
+func (n *notifier) run() {
+	defer close(n.done)
+	for a := range n.queue {
+		now := time.Now()
+		if n.limited(now) {
+			loggerError.Printf("notifier [%v] rate limit is exceeded, alert [%v] is skipped\n", n.cfg.Name, a.Key)
+			continue
+		}
+		if n.duplicate(a, now) {
+			continue
+		}
+		n.count(now)
+		if err := n.send(a); err != nil {
+			// not delivered alert isn't deduplicated, so it can be raised again
+			loggerError.Printf("notifier [%v] alert [%v] is not delivered: %v\n", n.cfg.Name, a.Key, err)
+			continue
+		}
+		n.delivered(a, now)
+	}
+}
+
+// dispatcher sends alerts to all notifiers.
+type dispatcher struct {
+	notifiers []*notifier
+}
+
+// newDispatcher creates notifiers and starts them.
+// Running notifiers of the previous dispatcher with the same name and settings are kept,
+// so their deduplication and rate limit states are not lost after configuration reload.
+func newDispatcher(configs []NotifierCfg, prev *dispatcher) (*dispatcher, error) {
+	d := &dispatcher{notifiers: make([]*notifier, 0, len(configs))}
+	kept, started := make(map[*notifier]bool), []*notifier{}
+	for i := range configs {
+		cfg := &configs[i]
+		create, ok := notifiersMap[cfg.Type]
+		if !ok {
+			return nil, fmt.Errorf("notifier %v: unknown type '%v'", cfg.Name, cfg.Type)
+		}
+		impl, err := create(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Timeout < 1 {
+			cfg.Timeout = defaultNotifyTimeout
+		}
+		if cfg.RetryDelay < 1 {
+			cfg.RetryDelay = defaultRetryDelay
+		}
+		if n := prev.find(cfg, kept); n != nil {
+			kept[n] = true
+			d.notifiers = append(d.notifiers, n)
+			continue
+		}
+		n := &notifier{
+			cfg:   cfg,
+			impl:  impl,
+			queue: make(chan *Alert, notifyQueueSize),
+			sent:  make(map[string]sentAlert),
+			done:  make(chan struct{}),
+		}
+		d.notifiers = append(d.notifiers, n)
+		started = append(started, n)
+	}
+	for _, n := range started {
+		go n.run()
+	}
+	return d, nil
+}
+
+// find returns not skipped notifier with the same settings, it is nil if there is no such one.
+func (d *dispatcher) find(cfg *NotifierCfg, skip map[*notifier]bool) *notifier {
+	if d == nil {
+		return nil
+	}
+	for _, n := range d.notifiers {
+		if !skip[n] && n.cfg.Name == cfg.Name && reflect.DeepEqual(*n.cfg, *cfg) {
+			return n
+		}
+	}
+	return nil
+}
+
+// has checks that the notifier is used by the dispatcher.
+func (d *dispatcher) has(n *notifier) bool {
+	if d == nil {
+		return false
+	}
+	for _, item := range d.notifiers {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch queues the alert for all notifiers, it doesn't block if a queue is full.
+func (d *dispatcher) dispatch(a *Alert) {
+	for _, n := range d.notifiers {
+		select {
+		case n.queue <- a:
+		default:
+			loggerError.Printf("notifier [%v] queue is full, alert [%v] is skipped\n", n.cfg.Name, a.Key)
+		}
+	}
+}
+
+// stop waits queued notifications and stops notifiers.
+func (d *dispatcher) stop() {
+	d.release(nil)
+}
+
+// release stops notifiers which are not kept by the next dispatcher,
+// it waits their queued notifications.
+func (d *dispatcher) release(next *dispatcher) {
+	stopped := []*notifier{}
+	for _, n := range d.notifiers {
+		if !next.has(n) {
+			close(n.queue)
+			stopped = append(stopped, n)
+		}
+	}
+	for _, n := range stopped {
+		<-n.done
+	}
+}
@@ -0,0 +1,442 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubNotifier records alerts, it fails first fails calls.
+type stubNotifier struct {
+	sync.Mutex
+	fails  int
+	calls  int
+	alerts []*Alert
+}
+
+// Notify saves the alert.
+func (n *stubNotifier) Notify(ctx context.Context, a *Alert) error {
+	n.Lock()
+	defer n.Unlock()
+	n.calls++
+	if n.calls <= n.fails {
+		return errors.New("stub error")
+	}
+	n.alerts = append(n.alerts, a)
+	return nil
+}
+
+// testAlert returns new test alert.
+func testAlert(key, state string) *Alert {
+	return &Alert{
+		Key:        key,
+		Kind:       alertRule,
+		State:      state,
+		ClientID:   "0102",
+		ClientName: "client",
+		ServiceID:  7,
+		Service:    "cpu",
+		Message:    "test message",
+		Started:    time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var received *Alert
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("invalid content type %v", ct)
+		}
+		received = &Alert{}
+		if err := json.NewDecoder(r.Body).Decode(received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	n, err := newWebhookNotifier(&NotifierCfg{Name: "webhook", URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Notify(context.Background(), testAlert("a", alertFiring)); err != nil {
+		t.Fatal(err)
+	}
+	if received == nil || received.Key != "a" || received.State != alertFiring || received.Service != "cpu" {
+		t.Errorf("invalid received alert %+v", received)
+	}
+	status = http.StatusInternalServerError
+	if err = n.Notify(context.Background(), testAlert("a", alertFiring)); err == nil {
+		t.Error("expected error of failed response")
+	}
+	if _, err = newWebhookNotifier(&NotifierCfg{Name: "webhook"}); err == nil {
+		t.Error("expected error of empty url")
+	}
+}
+
+// smtpStub is a local SMTP server which accepts one message.
+func smtpStub(t *testing.T, messages chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+		reply := func(line string) {
+			w.WriteString(line + "\r\n")
+			w.Flush()
+		}
+		reply("220 localhost ESMTP stub")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 end data with <CR><LF>.<CR><LF>")
+				data := []string{}
+				for {
+					line, err = r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data = append(data, line)
+				}
+				messages <- strings.Join(data, "")
+				reply("250 OK")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return ln
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	messages := make(chan string, 1)
+	ln := smtpStub(t, messages)
+	defer ln.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	cfg := &NotifierCfg{Name: "smtp", Host: "127.0.0.1", Port: uint(addr.Port), From: "meerkat@localhost", To: []string{"admin@localhost"}}
+	n, err := newSMTPNotifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := testAlert("a", alertResolved)
+	a.Resolved = a.Started.Add(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = n.Notify(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-messages
+	for _, s := range []string{"To: admin@localhost", "Subject: " + alertSubject(a), "test message", "Resolved: 2018-01-02T03:05:05Z"} {
+		if !strings.Contains(msg, s) {
+			t.Errorf("not found %q in message %q", s, msg)
+		}
+	}
+	if _, err = newSMTPNotifier(&NotifierCfg{Name: "smtp", Host: "127.0.0.1"}); err == nil {
+		t.Error("expected error of empty from and to")
+	}
+}
+
+func TestExecNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meerkat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "notify.sh")
+	content := "#!/bin/sh\necho \"$MEERKAT_ALERT_KEY $MEERKAT_ALERT_STATE $MEERKAT_ALERT_SERVICE_NAME\" > " + out + "\ncat >> " + out + "\n"
+	if err = ioutil.WriteFile(script, []byte(content), 0700); err != nil {
+		t.Fatal(err)
+	}
+	n, err := newExecNotifier(&NotifierCfg{Name: "exec", Exec: script})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Notify(context.Background(), testAlert("a", alertFiring)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitN(string(data), "\n", 2)
+	if lines[0] != "a firing cpu" {
+		t.Errorf("invalid environment %q", lines[0])
+	}
+	a := &Alert{}
+	if err = json.Unmarshal([]byte(lines[1]), a); err != nil || a.Key != "a" {
+		t.Errorf("invalid stdin %q: %v", lines[1], err)
+	}
+
+	failed := filepath.Join(dir, "failed.sh")
+	if err = ioutil.WriteFile(failed, []byte("#!/bin/sh\necho failed\nexit 3\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	n, err = newExecNotifier(&NotifierCfg{Name: "exec", Exec: failed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Notify(context.Background(), testAlert("a", alertFiring)); err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("expected command error with output, got %v", err)
+	}
+}
+
+func TestNotifierDuplicate(t *testing.T) {
+	n := &notifier{cfg: &NotifierCfg{Dedup: 60}, sent: make(map[string]sentAlert)}
+	now := time.Now()
+	cases := []struct {
+		key, state string
+		offset     time.Duration
+		duplicate  bool
+	}{
+		{"a", alertFiring, 0, false},
+		{"a", alertFiring, time.Second, true},
+		{"b", alertFiring, time.Second, false},
+		{"a", alertResolved, 2 * time.Second, false},
+		// fired again after resolving
+		{"a", alertFiring, 3 * time.Second, false},
+		{"a", alertFiring, 4 * time.Second, true},
+		// deduplication period is expired
+		{"a", alertFiring, 64 * time.Second, false},
+	}
+	for i, c := range cases {
+		a, at := testAlert(c.key, c.state), now.Add(c.offset)
+		d := n.duplicate(a, at)
+		if d != c.duplicate {
+			t.Errorf("case %v: expected duplicate=%v, got %v", i, c.duplicate, d)
+		}
+		if !d {
+			n.delivered(a, at)
+		}
+	}
+	// not delivered alert isn't a duplicate
+	if n.duplicate(testAlert("c", alertFiring), now.Add(65*time.Second)) {
+		t.Error("unexpected duplicate of not delivered alert")
+	}
+	// deduplication is disabled
+	n = &notifier{cfg: &NotifierCfg{}, sent: make(map[string]sentAlert)}
+	for i := 0; i < 2; i++ {
+		a := testAlert("a", alertFiring)
+		if n.duplicate(a, now) {
+			t.Error("unexpected duplicate without deduplication")
+		}
+		n.delivered(a, now)
+	}
+}
+
+func TestNotifierLimited(t *testing.T) {
+	n := &notifier{cfg: &NotifierCfg{RateLimit: 2}}
+	now := time.Now()
+	for i, expected := range []bool{false, false, true} {
+		at := now.Add(time.Duration(i) * time.Second)
+		l := n.limited(at)
+		if l != expected {
+			t.Errorf("notification %v: expected limited=%v, got %v", i, expected, l)
+		}
+		if !l {
+			n.count(at)
+		}
+	}
+	if n.limited(now.Add(61 * time.Second)) {
+		t.Error("unexpected limit after a minute")
+	}
+	n = &notifier{cfg: &NotifierCfg{}}
+	for i := 0; i < 10; i++ {
+		if n.limited(now) {
+			t.Error("unexpected limit without rate limit")
+		}
+		n.count(now)
+	}
+	if len(n.history) != 0 {
+		t.Errorf("unexpected history %v", len(n.history))
+	}
+}
+
+func TestNotifierSend(t *testing.T) {
+	stub := &stubNotifier{fails: 2}
+	n := &notifier{cfg: &NotifierCfg{Name: "stub", Retries: 2, Timeout: 1}, impl: stub}
+	if err := n.send(testAlert("a", alertFiring)); err != nil {
+		t.Fatal(err)
+	}
+	if stub.calls != 3 || len(stub.alerts) != 1 {
+		t.Errorf("expected 3 attempts and 1 alert, got %v and %v", stub.calls, len(stub.alerts))
+	}
+	stub = &stubNotifier{fails: 2}
+	n = &notifier{cfg: &NotifierCfg{Name: "stub", Retries: 1, Timeout: 1}, impl: stub}
+	if err := n.send(testAlert("a", alertFiring)); err == nil {
+		t.Error("expected error after retries")
+	}
+	if stub.calls != 2 {
+		t.Errorf("expected 2 attempts, got %v", stub.calls)
+	}
+}
+
+func TestNotifierRun(t *testing.T) {
+	// the first alert isn't delivered, the third one exceeds rate limit
+	stub := &stubNotifier{fails: 1}
+	n := &notifier{
+		cfg:   &NotifierCfg{Name: "stub", Timeout: 1, Dedup: 60, RateLimit: 2},
+		impl:  stub,
+		queue: make(chan *Alert, 4),
+		sent:  make(map[string]sentAlert),
+		done:  make(chan struct{}),
+	}
+	for _, a := range []*Alert{
+		testAlert("a", alertFiring),
+		testAlert("a", alertFiring),
+		testAlert("b", alertFiring),
+	} {
+		n.queue <- a
+	}
+	close(n.queue)
+	n.run()
+
+	if stub.calls != 2 || len(stub.alerts) != 1 || stub.alerts[0].Key != "a" {
+		t.Errorf("unexpected notifications: %v calls, %v alerts", stub.calls, len(stub.alerts))
+	}
+	if _, ok := n.sent["a"]; !ok {
+		t.Error("delivered alert isn't saved")
+	}
+	if _, ok := n.sent["b"]; ok {
+		t.Error("skipped alert is saved")
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	var mu sync.Mutex
+	received := []string{}
+	failed := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !failed {
+			// the first request is retried
+			failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		a := &Alert{}
+		if err := json.NewDecoder(r.Body).Decode(a); err != nil {
+			t.Error(err)
+		}
+		received = append(received, a.Key+":"+a.State)
+	}))
+	defer srv.Close()
+
+	cfg := []NotifierCfg{{Name: "webhook", Type: "webhook", URL: srv.URL, Retries: 1, Dedup: 60, RateLimit: 3}}
+	d, err := newDispatcher(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []*Alert{
+		testAlert("a", alertFiring),
+		testAlert("a", alertFiring),   // duplicate
+		testAlert("a", alertResolved), // resolved
+		testAlert("a", alertFiring),   // fired again
+		testAlert("b", alertFiring),   // rate limit
+	} {
+		d.dispatch(a)
+	}
+	d.stop()
+
+	expected := []string{"a:firing", "a:resolved", "a:firing"}
+	if strings.Join(received, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected notifications %v, got %v", expected, received)
+	}
+	if _, err = newDispatcher([]NotifierCfg{{Name: "unknown", Type: "unknown"}}, nil); err == nil {
+		t.Error("expected error of unknown notifier type")
+	}
+}
+
+func TestDispatcherReload(t *testing.T) {
+	configs := func(url string) []NotifierCfg {
+		return []NotifierCfg{
+			{Name: "kept", Type: "webhook", URL: "http://127.0.0.1/kept", Dedup: 60},
+			{Name: "changed", Type: "webhook", URL: url},
+		}
+	}
+	prev, err := newDispatcher(configs("http://127.0.0.1/a"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := prev.notifiers[0]
+	kept.sent["a"] = sentAlert{state: alertFiring, time: time.Now()}
+
+	d, err := newDispatcher(configs("http://127.0.0.1/b"), prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.notifiers[0] != kept {
+		t.Error("notifier with the same settings is not kept")
+	}
+	if d.notifiers[1] == prev.notifiers[1] {
+		t.Error("notifier with changed settings is kept")
+	}
+	prev.release(d)
+	select {
+	case <-prev.notifiers[1].done:
+	default:
+		t.Error("removed notifier is not stopped")
+	}
+	select {
+	case <-kept.done:
+		t.Error("kept notifier is stopped")
+	default:
+	}
+	if _, ok := kept.sent["a"]; !ok {
+		t.Error("deduplication state is lost")
+	}
+	d.stop()
+	select {
+	case <-kept.done:
+	default:
+		t.Error("kept notifier is not stopped")
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements server part of Meerkat project.
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RegisteredService is a client's service info from its registration.
+type RegisteredService struct {
+	ID     int    `bson:"id" json:"id"`
+	Name   string `bson:"name" json:"name"`
+	Type   string `bson:"type" json:"type"`
+	Period int    `bson:"period" json:"period"`
+}
+
+// Host is a client's host info from its registration.
+type Host struct {
+	Hostname string `bson:"hostname" json:"hostname"`
+	OS       string `bson:"os" json:"os"`
+	Version  string `bson:"version" json:"version"`
+	Revision string `bson:"revision" json:"revision"`
+}
+
+// RegisterClient saves client's registration info.
+func RegisterClient(ctx context.Context, name, clientID, addr string, host *Host, services []RegisteredService, t time.Time) error {
+	session, err := copySession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	update := bson.M{
+		"$set": bson.M{
+			"name":          name,
+			"addr":          addr,
+			"last_seen":     t,
+			"host":          host,
+			"registered":    services,
+			"registered_at": t,
+		},
+		"$setOnInsert": bson.M{"first_seen": t},
+	}
+	_, err = session.DB("").C(clientsCollection).UpsertId(clientID, update)
+	return err
+}
+
+// serviceNames is services names of clients by their identifiers.
+// It is safe for concurrent use.
+type serviceNames struct {
+	sync.RWMutex
+	names map[serviceKey]string
+}
+
+// newServiceNames returns new services names registry.
+func newServiceNames() *serviceNames {
+	return &serviceNames{names: make(map[serviceKey]string)}
+}
+
+// set replaces registered services of the client.
+func (sn *serviceNames) set(clientID string, services []RegisteredService) {
+	sn.Lock()
+	defer sn.Unlock()
+
+	for key := range sn.names {
+		if key.clientID == clientID {
+			delete(sn.names, key)
+		}
+	}
+	for _, s := range services {
+		sn.names[serviceKey{clientID: clientID, serviceID: uint16(s.ID)}] = s.Name
+	}
+}
+
+// name returns registered service name, it is empty for unknown service.
+func (sn *serviceNames) name(clientID string, serviceID uint16) string {
+	sn.RLock()
+	defer sn.RUnlock()
+	return sn.names[serviceKey{clientID: clientID, serviceID: serviceID}]
+}
+
+// load reads registered services of known clients from the database.
+func (sn *serviceNames) load(ctx context.Context) error {
+	clients, err := Clients(ctx)
+	if err != nil {
+		return err
+	}
+	for _, c := range clients {
+		sn.set(c.ClientID, c.Registered)
+	}
+	return nil
+}
+
+// newHost returns host info of registration message.
+func newHost(reg *packet.Registration) *Host {
+	return &Host{Hostname: reg.Hostname, OS: reg.OS, Version: reg.Version, Revision: reg.Revision}
+}
+
+// newRegisteredServices converts registration message services.
+func newRegisteredServices(reg *packet.Registration) []RegisteredService {
+	services := make([]RegisteredService, len(reg.Services))
+	for i, s := range reg.Services {
+		services[i] = RegisteredService{ID: int(s.ID), Name: s.Name, Type: s.Type, Period: int(s.Period)}
+	}
+	return services
+}
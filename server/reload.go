@@ -0,0 +1,120 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements server part of Meerkat project.
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"sync"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+// keyring is server private keys, previous key is accepted during its rotation window.
+// It is safe for concurrent use.
+type keyring struct {
+	sync.RWMutex
+	current  *rsa.PrivateKey
+	previous *rsa.PrivateKey
+	expires  time.Time
+}
+
+// newKeyring returns new keyring with current private key.
+func newKeyring(key *rsa.PrivateKey) *keyring {
+	return &keyring{current: key}
+}
+
+// rotate sets new current key, the previous one is still accepted during window period.
+// It returns false if the key is not changed.
+func (kr *keyring) rotate(key *rsa.PrivateKey, window time.Duration, now time.Time) bool {
+	kr.Lock()
+	defer kr.Unlock()
+
+	if kr.current.E == key.E && kr.current.N.Cmp(key.N) == 0 {
+		return false
+	}
+	kr.previous, kr.current, kr.expires = kr.current, key, now.Add(window)
+	return true
+}
+
+// open decrypts data by current key or by previous one if its rotation window is not expired.
+// It returns the key which was used for decryption.
+func (kr *keyring) open(data []byte, now time.Time) ([]byte, *rsa.PrivateKey, error) {
+	kr.RLock()
+	current, previous, expires := kr.current, kr.previous, kr.expires
+	kr.RUnlock()
+
+	b, err := packet.Open(current, data)
+	if err == nil || previous == nil || now.After(expires) {
+		return b, current, err
+	}
+	if b, e := packet.Open(previous, data); e == nil {
+		return b, previous, nil
+	}
+	return nil, current, err
+}
+
+// reload reads configuration file and applies its changes,
+// database is reconnected if its settings are changed.
+// Server addresses, workers and web admin settings are not reloaded, their changes require restart.
+func (rc *receiver) reload(ctx context.Context, fileName string) error {
+	cfg, err := Configuration(fileName)
+	if err != nil {
+		return err
+	}
+	d, err := newDispatcher(cfg.Notifiers, rc.dispatcher)
+	if err != nil {
+		return err
+	}
+	if cfg.Db.changed(&rc.cfg.Db) {
+		if err = cfg.DbReconnect(ctx); err != nil {
+			d.release(rc.dispatcher)
+			return err
+		}
+		loggerInfo.Println("database is reconnected")
+		if err = ensureIndexes(ctx); err != nil {
+			loggerError.Printf("indexes error: %v\n", err)
+		}
+	}
+	if cfg.Server.Host != rc.cfg.Server.Host || cfg.Server.Port != rc.cfg.Server.Port || cfg.WebAdmin != rc.cfg.WebAdmin ||
+		cfg.Server.Workers != rc.cfg.Server.Workers || cfg.Server.QueueSize != rc.cfg.Server.QueueSize {
+		loggerError.Println("server addresses, workers and web admin changes require restart")
+	}
+	window := time.Duration(cfg.Server.KeyRotation) * time.Second
+	if rc.keys.rotate(cfg.Server.privateKey, window, time.Now()) {
+		loggerInfo.Printf("server key is changed, previous one is accepted during %v\n", window)
+	}
+	rc.replay.setMaxSkew(time.Duration(cfg.Server.MaxSkew) * time.Second)
+	rc.heartbeats.setPeriods(cfg.Server.StalePeriods)
+	resolved := rc.rules.replace(cfg.Rules, time.Now().UTC())
+	rc.Lock()
+	old := rc.dispatcher
+	rc.cfg, rc.dispatcher = cfg, d
+	rc.Unlock()
+	// handled datagrams don't use the previous dispatcher after the lock,
+	// its removed notifiers are stopped in background, so the listen loop isn't blocked by retries
+	rc.released.Add(1)
+	go func() {
+		defer rc.released.Done()
+		old.release(d)
+	}()
+	for _, a := range resolved {
+		raise(ctx, d, a)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements server part of Meerkat project.
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+var (
+	// errStale is an error when packet is too old.
+	errStale = errors.New("stale packet")
+	// errDuplicate is an error when packet was already received and handled.
+	errDuplicate = errors.New("duplicate packet")
+	// errInProgress is an error when packet with the same sequence number is being handled.
+	errInProgress = errors.New("packet is in progress")
+)
+
+// sequenceState is a state of the received sequence number.
+type sequenceState struct {
+	received time.Time
+	handled  bool
+}
+
+// sequenceWindow is a set of client's sequence numbers received during the recent time window.
+// Packets which are older than the window are rejected by timestamp,
+// so retransmissions of any age within the window are recognized.
+type sequenceWindow struct {
+	sequences map[uint64]*sequenceState
+	pruned    time.Time
+}
+
+// newSequenceWindow returns new empty sequence window.
+func newSequenceWindow(now time.Time) *sequenceWindow {
+	return &sequenceWindow{sequences: make(map[uint64]*sequenceState), pruned: now}
+}
+
+// accept checks the sequence number and marks it as received but not handled yet.
+func (sw *sequenceWindow) accept(seq uint64, now time.Time) error {
+	if s, ok := sw.sequences[seq]; ok {
+		if s.handled {
+			return errDuplicate
+		}
+		return errInProgress
+	}
+	sw.sequences[seq] = &sequenceState{received: now}
+	return nil
+}
+
+// done marks the sequence number as handled or forgets it if the handling failed,
+// so the retransmitted packet will be accepted again.
+func (sw *sequenceWindow) done(seq uint64, handled bool) {
+	if !handled {
+		delete(sw.sequences, seq)
+		return
+	}
+	if s, ok := sw.sequences[seq]; ok {
+		s.handled = true
+	}
+}
+
+// prune removes sequence numbers which were received before the time window.
+func (sw *sequenceWindow) prune(now time.Time, window time.Duration) {
+	if now.Sub(sw.pruned) < window {
+		return
+	}
+	for seq, s := range sw.sequences {
+		if now.Sub(s.received) > window {
+			delete(sw.sequences, seq)
+		}
+	}
+	sw.pruned = now
+}
+
+// replayFilter drops stale and duplicate packets.
+// It is safe for concurrent use.
+type replayFilter struct {
+	sync.Mutex
+	maxSkew time.Duration
+	windows map[string]*sequenceWindow
+}
+
+// newReplayFilter returns new replay filter with allowed clock skew.
+func newReplayFilter(maxSkew time.Duration) *replayFilter {
+	return &replayFilter{maxSkew: maxSkew, windows: make(map[string]*sequenceWindow)}
+}
+
+// setMaxSkew changes allowed clock skew.
+func (rf *replayFilter) setMaxSkew(maxSkew time.Duration) {
+	rf.Lock()
+	defer rf.Unlock()
+	rf.maxSkew = maxSkew
+}
+
+// check returns an error if the packet is stale or duplicate.
+// An accepted packet must be marked by done after its handling.
+func (rf *replayFilter) check(p *packet.Packet, now time.Time) error {
+	err := rf.accept(p, now)
+	switch err {
+	case errStale:
+		atomic.AddUint64(&counters.Stale, 1)
+	case errDuplicate, errInProgress:
+		atomic.AddUint64(&counters.Duplicate, 1)
+	}
+	return err
+}
+
+// accept checks packet timestamp and sequence number.
+func (rf *replayFilter) accept(p *packet.Packet, now time.Time) error {
+	skew := now.Sub(time.Unix(0, p.Timestamp))
+	rf.Lock()
+	defer rf.Unlock()
+
+	if skew > rf.maxSkew || skew < -rf.maxSkew {
+		return errStale
+	}
+	key := string(p.ClientID)
+	sw, ok := rf.windows[key]
+	if !ok {
+		sw = newSequenceWindow(now)
+		rf.windows[key] = sw
+	}
+	// packet timestamp can differ from receiving time by maxSkew in both directions
+	sw.prune(now, 2*rf.maxSkew)
+	return sw.accept(p.Sequence, now)
+}
+
+// done marks accepted packet as handled or forgets it if the handling failed.
+func (rf *replayFilter) done(p *packet.Packet, handled bool) {
+	rf.Lock()
+	defer rf.Unlock()
+	if sw, ok := rf.windows[string(p.ClientID)]; ok {
+		sw.done(p.Sequence, handled)
+	}
+}
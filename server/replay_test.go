@@ -0,0 +1,107 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+func TestSequenceWindow(t *testing.T) {
+	now := time.Now()
+	sw := newSequenceWindow(now)
+	steps := []struct {
+		seq     uint64
+		handled bool
+		err     error
+	}{
+		{seq: 1, handled: true},
+		{seq: 3, handled: true},
+		{seq: 2, handled: true},
+		{seq: 1, err: errDuplicate},
+		{seq: 3, err: errDuplicate},
+		{seq: 100, handled: true},
+		{seq: 4, handled: true}, // far behind the last one, but not received
+		{seq: 4, err: errDuplicate},
+		{seq: 5, handled: false}, // handling is failed
+		{seq: 5, handled: true},  // retransmission is accepted again
+		{seq: 5, err: errDuplicate},
+	}
+	for i, s := range steps {
+		if err := sw.accept(s.seq, now); err != s.err {
+			t.Fatalf("step %v, sequence %v: unexpected error %v", i, s.seq, err)
+		}
+		if s.err == nil {
+			sw.done(s.seq, s.handled)
+		}
+	}
+	if err := sw.accept(6, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.accept(6, now); err != errInProgress {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSequenceWindowPrune(t *testing.T) {
+	now := time.Now()
+	sw := newSequenceWindow(now)
+	if err := sw.accept(1, now); err != nil {
+		t.Fatal(err)
+	}
+	sw.done(1, true)
+
+	sw.prune(now.Add(time.Second), time.Minute)
+	if err := sw.accept(1, now); err != errDuplicate {
+		t.Errorf("unexpected error %v", err)
+	}
+	sw.prune(now.Add(2*time.Minute), time.Minute)
+	if n := len(sw.sequences); n != 0 {
+		t.Errorf("unexpected sequences %v", n)
+	}
+}
+
+func TestReplayFilter(t *testing.T) {
+	now := time.Now()
+	rf := newReplayFilter(time.Minute)
+	p := &packet.Packet{ClientID: []byte("client"), Sequence: 1, Timestamp: now.UnixNano()}
+
+	if err := rf.check(p, now); err != nil {
+		t.Fatal(err)
+	}
+	rf.done(p, false)
+	if err := rf.check(p, now); err != nil {
+		t.Errorf("failed packet is not accepted: %v", err)
+	}
+	rf.done(p, true)
+	if err := rf.check(p, now); err != errDuplicate {
+		t.Errorf("unexpected error %v", err)
+	}
+	other := &packet.Packet{ClientID: []byte("other"), Sequence: 1, Timestamp: now.UnixNano()}
+	if err := rf.check(other, now); err != nil {
+		t.Errorf("packet of other client is not accepted: %v", err)
+	}
+	old := &packet.Packet{ClientID: p.ClientID, Sequence: 2, Timestamp: now.Add(-2 * time.Minute).UnixNano()}
+	if err := rf.check(old, now); err != errStale {
+		t.Errorf("unexpected error %v", err)
+	}
+	future := &packet.Packet{ClientID: p.ClientID, Sequence: 3, Timestamp: now.Add(2 * time.Minute).UnixNano()}
+	if err := rf.check(future, now); err != errStale {
+		t.Errorf("unexpected error %v", err)
+	}
+}
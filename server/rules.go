@@ -0,0 +1,277 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements server part of Meerkat project.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+const (
+	// alertRule is a kind of alert produced by rules.
+	alertRule = "rule"
+)
+
+// comparisons is supported rules operators.
+var comparisons = map[string]func(float64, float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+// Rule is an alerting rule of received values.
+// Empty Client and nil Service with empty ServiceName match any client and service.
+type Rule struct {
+	Name        string            `json:"name"`
+	Client      string            `json:"client"`
+	Service     *int              `json:"service"`
+	ServiceName string            `json:"service_name"`
+	Field       string            `json:"field"`
+	Labels      map[string]string `json:"labels"`
+	Op          string            `json:"op"`
+	Threshold   float64           `json:"threshold"`
+	For         int               `json:"for"`
+}
+
+// validate checks rule settings.
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule name is required")
+	}
+	if _, ok := comparisons[r.Op]; !ok {
+		return fmt.Errorf("rule %v: unknown operator '%v'", r.Name, r.Op)
+	}
+	if r.For < 0 {
+		return fmt.Errorf("rule %v: negative for-duration", r.Name)
+	}
+	return nil
+}
+
+// match checks that the rule is applicable to the client's service.
+func (r *Rule) match(client *Client, record *Record) bool {
+	if r.Client != "" && r.Client != client.Name {
+		return false
+	}
+	if r.ServiceName != "" && r.ServiceName != record.Service {
+		return false
+	}
+	return r.Service == nil || *r.Service == record.ServiceID
+}
+
+// value returns numeric value of the rule field from the record.
+func (r *Rule) value(record *Record) (float64, error) {
+	switch {
+	case record.Format == int(packet.FormatMetrics):
+		return r.metricValue(record.Metrics)
+	case record.Result != nil:
+		if value, err := r.metricValue(record.Metrics); err == nil {
+			return value, nil
+		}
+		return r.payloadValue([]byte(record.Result.Output))
+	}
+	return r.payloadValue(record.Payload)
+}
+
+// metricValue returns value of the metric with the field name and all rule labels.
+func (r *Rule) metricValue(metrics []Metric) (float64, error) {
+	for i := range metrics {
+		m := &metrics[i]
+		if m.Name != r.Field {
+			continue
+		}
+		found := true
+		for k, v := range r.Labels {
+			if m.Labels[k] != v {
+				found = false
+				break
+			}
+		}
+		if found {
+			return m.Value, nil
+		}
+	}
+	return 0, fmt.Errorf("not found metric %v", r.Field)
+}
+
+// payloadValue returns numeric value of the rule field from the raw payload.
+// JSON payload field is found by dot separated path, whole payload is used if the field is empty.
+func (r *Rule) payloadValue(payload []byte) (float64, error) {
+	if r.Field == "" {
+		return strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	}
+	var data interface{}
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return 0, err
+	}
+	for _, name := range strings.Split(r.Field, ".") {
+		switch v := data.(type) {
+		case map[string]interface{}:
+			data = v[name]
+		case []interface{}:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= len(v) {
+				return 0, fmt.Errorf("invalid index '%v' of field %v", name, r.Field)
+			}
+			data = v[i]
+		default:
+			return 0, fmt.Errorf("not found field %v", r.Field)
+		}
+	}
+	value, ok := data.(float64)
+	if !ok {
+		return 0, fmt.Errorf("field %v is not a number", r.Field)
+	}
+	return value, nil
+}
+
+// ruleState is a rule evaluation state of the client's service.
+type ruleState struct {
+	rule     string
+	since    time.Time
+	measured time.Time // measurement time of the last evaluated record
+	firing   bool
+	alert    *Alert // last firing alert
+}
+
+// rulesEngine evaluates rules on received packets.
+// It is safe for concurrent use.
+type rulesEngine struct {
+	sync.Mutex
+	rules  []Rule
+	states map[string]*ruleState
+}
+
+// newRulesEngine returns new rules engine.
+func newRulesEngine(rules []Rule) *rulesEngine {
+	return &rulesEngine{rules: rules, states: make(map[string]*ruleState)}
+}
+
+// replace sets new rules, states of the rules with the same names are kept.
+// States of removed rules are deleted, it returns resolved alerts of firing ones.
+func (re *rulesEngine) replace(rules []Rule, t time.Time) []*Alert {
+	re.Lock()
+	defer re.Unlock()
+
+	names := make(map[string]bool, len(rules))
+	for i := range rules {
+		names[rules[i].Name] = true
+	}
+	alerts := []*Alert{}
+	for key, state := range re.states {
+		if names[state.rule] {
+			continue
+		}
+		delete(re.states, key)
+		if state.firing && state.alert != nil {
+			a := *state.alert
+			a.ID = ""
+			a.State = alertResolved
+			a.Resolved = t
+			a.Message = fmt.Sprintf("rule %v is removed", state.rule)
+			alerts = append(alerts, &a)
+		}
+	}
+	re.rules = rules
+	return alerts
+}
+
+// restore sets firing state of the rule alert after server restart.
+func (re *rulesEngine) restore(a *Alert) {
+	re.Lock()
+	defer re.Unlock()
+
+	// key format is "kind:client:service:rule"
+	parts := strings.SplitN(a.Key, ":", 4)
+	re.states[a.Key] = &ruleState{rule: parts[len(parts)-1], since: a.Started, firing: true, alert: a}
+}
+
+// evaluate checks all matched rules and returns their changed alerts.
+// Records which were measured before the last evaluated one are skipped,
+// they can be received or handled out of order.
+func (re *rulesEngine) evaluate(client *Client, record *Record, t time.Time) []*Alert {
+	re.Lock()
+	defer re.Unlock()
+
+	alerts := []*Alert{}
+	for i := range re.rules {
+		r := &re.rules[i]
+		if !r.match(client, record) {
+			continue
+		}
+		value, err := r.value(record)
+		if err != nil {
+			loggerError.Printf("rule [%v] client %v service %v: %v\n", r.Name, client.Name, record.ServiceID, err)
+			continue
+		}
+		key := alertKey(alertRule, record.ClientID, record.ServiceID, r.Name)
+		state, ok := re.states[key]
+		if !ok {
+			state = &ruleState{rule: r.Name}
+			re.states[key] = state
+		}
+		if record.Measured.Before(state.measured) {
+			continue
+		}
+		state.measured = record.Measured
+		a := &Alert{
+			Key:        key,
+			Kind:       alertRule,
+			ClientID:   record.ClientID,
+			ClientName: client.Name,
+			ServiceID:  record.ServiceID,
+			Service:    record.Service,
+			Started:    t,
+		}
+		if comparisons[r.Op](value, r.Threshold) {
+			if state.firing {
+				continue
+			}
+			if state.since.IsZero() {
+				state.since = t
+			}
+			if t.Sub(state.since) < time.Duration(r.For)*time.Second {
+				continue
+			}
+			state.firing = true
+			a.State = alertFiring
+			a.Started = state.since
+			a.Message = fmt.Sprintf("rule %v: %v %v %v", r.Name, value, r.Op, r.Threshold)
+			state.alert = a
+			alerts = append(alerts, a)
+		} else {
+			state.since = time.Time{}
+			if !state.firing {
+				continue
+			}
+			state.firing = false
+			a.State = alertResolved
+			a.Resolved = t
+			a.Message = fmt.Sprintf("rule %v: value is %v", r.Name, value)
+			alerts = append(alerts, a)
+		}
+	}
+	return alerts
+}
@@ -17,13 +17,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"runtime"
 	"sync"
+	"syscall"
 
 	"github.com/z0rr0/meerkat/packet"
 )
@@ -76,6 +79,15 @@ func main() {
 	}
 	loggerInfo.Printf("configuration is read\n%v:%v\n", cfg.Server.Host, cfg.Server.Port)
 
+	ctx, err := cfg.DbConnect(context.Background())
+	if err != nil {
+		loggerError.Fatalln(err)
+	}
+	defer cfg.Close(ctx)
+	if err = ensureIndexes(ctx); err != nil {
+		loggerError.Fatalln(err)
+	}
+
 	udpConn, err := net.ListenUDP("udp", cfg.Server.UDPAddr())
 	if err != nil {
 		loggerError.Fatalln(err)
@@ -86,13 +98,33 @@ func main() {
 	stopChan := make(chan bool)
 	defer close(errChan)
 
+	// dispatcher is stopped by listen
+	d, err := newDispatcher(cfg.Notifiers, nil)
+	if err != nil {
+		loggerError.Fatalln(err)
+	}
+
+	srv := webServer(ctx, &cfg.WebAdmin)
+	wg.Add(1)
+	go runWebServer(srv, &wg)
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
 	go packet.Interrupt(errChan)
-	go listen(udpConn, cfg.Server.privateKey, &wg, stopChan)
+	go listen(ctx, udpConn, cfg, d, *config, reload, &wg, stopChan)
 
 	// wait error or valid interrupt
 	err = <-errChan
 	// stop upd socket read
 	close(stopChan)
+	// stop web admin
+	shutdownCtx, cancel := context.WithTimeout(ctx, webTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		loggerError.Printf("web admin shutdown error: %v\n", err)
+	}
 	// wait graceful stop
 	wg.Wait()
 
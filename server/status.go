@@ -0,0 +1,114 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements server part of Meerkat project.
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+)
+
+const (
+	// alertStatus is a kind of alert about not OK check status.
+	alertStatus = "status"
+)
+
+// serviceStatus is a last check status of service.
+type serviceStatus struct {
+	status   int
+	measured time.Time
+}
+
+// statuses tracks check statuses of services and detects their changes.
+// It is safe for concurrent use.
+type statuses struct {
+	sync.Mutex
+	items map[serviceKey]*serviceStatus
+}
+
+// newStatuses returns new check statuses tracker.
+func newStatuses() *statuses {
+	return &statuses{items: make(map[serviceKey]*serviceStatus)}
+}
+
+// restore sets not OK status of firing alert after server restart.
+func (ss *statuses) restore(a *Alert) {
+	status := a.Status
+	if status == int(packet.StatusOK) {
+		// alert was saved without status
+		status = int(packet.StatusUnknown)
+	}
+	ss.Lock()
+	defer ss.Unlock()
+	ss.items[serviceKey{clientID: a.ClientID, serviceID: uint16(a.ServiceID)}] = &serviceStatus{status: status}
+}
+
+// update saves new check status of the record service and returns alerts of its change.
+// Record without check result has OK status, e.g. successful command output after timeout.
+// Changing of not OK status resolves the previous alert and fires a new one.
+// Records which were measured before the last one are skipped.
+func (ss *statuses) update(client *Client, r *Record, t time.Time) []*Alert {
+	result := r.Result
+	if result == nil {
+		result = &Result{Status: int(packet.StatusOK), StatusName: packet.StatusName(packet.StatusOK)}
+	}
+	ss.Lock()
+	defer ss.Unlock()
+
+	key := serviceKey{clientID: r.ClientID, serviceID: uint16(r.ServiceID)}
+	item, ok := ss.items[key]
+	if !ok {
+		item = &serviceStatus{status: int(packet.StatusOK)}
+		ss.items[key] = item
+	}
+	if r.Measured.Before(item.measured) {
+		return nil
+	}
+	prev := item.status
+	item.status, item.measured = result.Status, r.Measured
+	if prev == result.Status {
+		return nil
+	}
+	alerts := []*Alert{}
+	base := Alert{
+		Key:        alertKey(alertStatus, r.ClientID, r.ServiceID, ""),
+		Kind:       alertStatus,
+		ClientID:   r.ClientID,
+		ClientName: client.Name,
+		ServiceID:  r.ServiceID,
+		Service:    r.Service,
+		Started:    t,
+	}
+	if prev != int(packet.StatusOK) {
+		a := base
+		a.State = alertResolved
+		a.Resolved = t
+		a.Message = fmt.Sprintf("status changed from %v to %v: %v",
+			packet.StatusName(uint8(prev)), result.StatusName, result.Output)
+		alerts = append(alerts, &a)
+	}
+	if result.Status != int(packet.StatusOK) {
+		a := base
+		a.State = alertFiring
+		a.Status = result.Status
+		a.Message = fmt.Sprintf("status %v: %v", result.StatusName, result.Output)
+		alerts = append(alerts, &a)
+	}
+	return alerts
+}
@@ -0,0 +1,333 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements server part of Meerkat project.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/z0rr0/meerkat/packet"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// recordsCollection is MongoDB collection name for received packets.
+	recordsCollection = "records"
+	// clientsCollection is MongoDB collection name for known clients.
+	clientsCollection = "clients"
+)
+
+// collectionIndexes is MongoDB indexes of collections.
+var collectionIndexes = map[string][]mgo.Index{
+	recordsCollection: {
+		{Key: []string{"client_id", "service_id", "-received"}, Background: true},
+		{Key: []string{"-received"}, Background: true},
+	},
+	alertsCollection: {
+		{Key: []string{"key", "state"}, Background: true},
+		{Key: []string{"state", "-started"}, Background: true},
+	},
+}
+
+// Metric is a stored typed metric value.
+type Metric struct {
+	Name   string            `bson:"name" json:"name"`
+	Value  float64           `bson:"value" json:"value"`
+	Unit   string            `bson:"unit,omitempty" json:"unit,omitempty"`
+	Labels map[string]string `bson:"labels,omitempty" json:"labels,omitempty"`
+	Time   time.Time         `bson:"time" json:"time"`
+}
+
+// String returns text representation of the metric.
+func (m *Metric) String() string {
+	labels := make([]string, 0, len(m.Labels))
+	for k, v := range m.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	return strings.TrimSpace(fmt.Sprintf("%v %v %v %v", m.Name, m.Value, m.Unit, strings.Join(labels, " ")))
+}
+
+// Result is a stored check result.
+type Result struct {
+	Status     int     `bson:"status" json:"status"`
+	StatusName string  `bson:"status_name" json:"status_name"`
+	Output     string  `bson:"output" json:"output"`
+	ExitCode   int     `bson:"exit_code" json:"exit_code"`
+	Signal     string  `bson:"signal,omitempty" json:"signal,omitempty"`
+	Stderr     string  `bson:"stderr,omitempty" json:"stderr,omitempty"`
+	Duration   float64 `bson:"duration" json:"duration"` // seconds
+}
+
+// Record is a stored received packet.
+// Payload of metrics and result formats is stored decoded as Metrics and Result.
+type Record struct {
+	ID        bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	ClientID  string        `bson:"client_id" json:"client_id"`
+	ServiceID int           `bson:"service_id" json:"service_id"`
+	Service   string        `bson:"service_name,omitempty" json:"service_name,omitempty"`
+	Format    int           `bson:"format" json:"format"`
+	Payload   []byte        `bson:"payload,omitempty" json:"payload,omitempty"`
+	Result    *Result       `bson:"result,omitempty" json:"result,omitempty"`
+	Metrics   []Metric      `bson:"metrics,omitempty" json:"metrics,omitempty"`
+	Addr      string        `bson:"addr" json:"addr"`
+	Measured  time.Time     `bson:"measured" json:"measured"`
+	Received  time.Time     `bson:"received" json:"received"`
+}
+
+// ClientInfo is an info about known client.
+type ClientInfo struct {
+	ClientID     string              `bson:"_id" json:"client_id"`
+	Name         string              `bson:"name" json:"name"`
+	Addr         string              `bson:"addr" json:"addr"`
+	FirstSeen    time.Time           `bson:"first_seen" json:"first_seen"`
+	LastSeen     time.Time           `bson:"last_seen" json:"last_seen"`
+	Services     []int               `bson:"services" json:"services"`
+	Host         *Host               `bson:"host" json:"host"`
+	Registered   []RegisteredService `bson:"registered" json:"registered"`
+	RegisteredAt time.Time           `bson:"registered_at" json:"registered_at"`
+}
+
+// ServiceInfo is an aggregated info about client's service.
+type ServiceInfo struct {
+	ServiceID int       `bson:"_id" json:"service_id"`
+	Name      string    `bson:"name" json:"name"`
+	Measured  time.Time `bson:"measured" json:"measured"`
+	LastSeen  time.Time `bson:"last_seen" json:"last_seen"`
+	Addr      string    `bson:"addr" json:"addr"`
+	Format    int       `bson:"format" json:"format"`
+	Payload   []byte    `bson:"payload" json:"-"`
+	Result    *Result   `bson:"result" json:"result,omitempty"`
+	Metrics   []Metric  `bson:"metrics" json:"metrics,omitempty"`
+	Text      string    `bson:"-" json:"payload"`
+}
+
+// measuredTime returns measurement time of the packet, it is the receiving time if it is unknown.
+func measuredTime(p *packet.Packet, received time.Time) time.Time {
+	if p.Measured == 0 {
+		return received
+	}
+	return time.Unix(0, p.Measured).UTC()
+}
+
+// NewRecord returns new record for packet p received from addr.
+func NewRecord(p *packet.Packet, addr string) (*Record, error) {
+	received := time.Now().UTC()
+	r := &Record{
+		ClientID:  hex.EncodeToString(p.ClientID),
+		ServiceID: int(p.ServiceID),
+		Format:    int(p.Format),
+		Addr:      addr,
+		Measured:  measuredTime(p, received),
+		Received:  received,
+	}
+	switch p.Format {
+	case packet.FormatRaw:
+		r.Payload = p.Payload
+	case packet.FormatMetrics:
+		metrics, err := packet.DecodeMetrics(p.Payload)
+		if err != nil {
+			return nil, err
+		}
+		r.Metrics = newMetrics(metrics)
+	case packet.FormatResult:
+		result, err := packet.DecodeResult(p.Payload)
+		if err != nil {
+			return nil, err
+		}
+		r.Result = &Result{
+			Status:     int(result.Status),
+			StatusName: packet.StatusName(result.Status),
+			Output:     result.Output,
+			ExitCode:   result.ExitCode,
+			Signal:     result.Signal,
+			Stderr:     result.Stderr,
+			Duration:   result.Duration.Seconds(),
+		}
+		r.Metrics = newMetrics(result.Metrics)
+	default:
+		return nil, fmt.Errorf("unknown payload format %v", p.Format)
+	}
+	return r, nil
+}
+
+// newMetrics converts decoded metrics to stored ones.
+func newMetrics(metrics []packet.Metric) []Metric {
+	result := make([]Metric, len(metrics))
+	for i, m := range metrics {
+		result[i] = Metric{
+			Name:   m.Name,
+			Value:  m.Value,
+			Unit:   m.Unit,
+			Labels: m.Labels,
+			Time:   time.Unix(0, m.Timestamp).UTC(),
+		}
+	}
+	return result
+}
+
+// Text returns text representation of the record data.
+func (r *Record) Text() string {
+	return payloadText(r.Payload, r.Result, r.Metrics)
+}
+
+// payloadText returns raw payload as a string or result and metrics line by line.
+func payloadText(payload []byte, result *Result, metrics []Metric) string {
+	lines := make([]string, 0, len(metrics)+3)
+	if result != nil {
+		lines = append(lines, result.StatusName+": "+result.Output)
+		details := fmt.Sprintf("exit code %v, duration %.3fs", result.ExitCode, result.Duration)
+		if result.Signal != "" {
+			details += ", signal " + result.Signal
+		}
+		lines = append(lines, details)
+		if result.Stderr != "" {
+			lines = append(lines, "stderr: "+result.Stderr)
+		}
+	} else if len(metrics) == 0 {
+		return string(payload)
+	}
+	for i := range metrics {
+		lines = append(lines, metrics[i].String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// copySession returns a copy of the context's database session, it should be closed after usage.
+func copySession(ctx context.Context) (*mgo.Session, error) {
+	s, err := CtxGetDBSession(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.Copy(), nil
+}
+
+// ensureIndexes creates collections indexes if they don't exist.
+func ensureIndexes(ctx context.Context) error {
+	session, err := copySession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	for name, indexes := range collectionIndexes {
+		coll := session.DB("").C(name)
+		for _, index := range indexes {
+			if err := coll.EnsureIndex(index); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SaveRecord saves new record to the database.
+func SaveRecord(ctx context.Context, r *Record) error {
+	session, err := copySession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return session.DB("").C(recordsCollection).Insert(r)
+}
+
+// TrackClient updates client's info using its new record.
+func TrackClient(ctx context.Context, name string, r *Record) error {
+	session, err := copySession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	update := bson.M{
+		"$set":         bson.M{"name": name, "addr": r.Addr, "last_seen": r.Received},
+		"$setOnInsert": bson.M{"first_seen": r.Received},
+		"$addToSet":    bson.M{"services": r.ServiceID},
+	}
+	_, err = session.DB("").C(clientsCollection).UpsertId(r.ClientID, update)
+	return err
+}
+
+// Clients returns all known clients info.
+func Clients(ctx context.Context) ([]ClientInfo, error) {
+	session, err := copySession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	result := []ClientInfo{}
+	err = session.DB("").C(clientsCollection).Find(nil).Sort("_id").All(&result)
+	return result, err
+}
+
+// FindClient returns client info by its identifier, it is nil for unknown client.
+func FindClient(ctx context.Context, clientID string) (*ClientInfo, error) {
+	session, err := copySession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	result := &ClientInfo{}
+	err = session.DB("").C(clientsCollection).FindId(clientID).One(result)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	return result, err
+}
+
+// Services returns services info with latest payloads of the client.
+func Services(ctx context.Context, clientID string) ([]ServiceInfo, error) {
+	session, err := copySession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	result := []ServiceInfo{}
+	pipeline := []bson.M{
+		{"$match": bson.M{"client_id": clientID}},
+		{"$sort": bson.M{"received": -1}},
+		{"$group": bson.M{
+			"_id":       "$service_id",
+			"name":      bson.M{"$first": "$service_name"},
+			"measured":  bson.M{"$first": "$measured"},
+			"last_seen": bson.M{"$first": "$received"},
+			"addr":      bson.M{"$first": "$addr"},
+			"format":    bson.M{"$first": "$format"},
+			"payload":   bson.M{"$first": "$payload"},
+			"result":    bson.M{"$first": "$result"},
+			"metrics":   bson.M{"$first": "$metrics"},
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	}
+	err = session.DB("").C(recordsCollection).Pipe(pipeline).AllowDiskUse().All(&result)
+	if err != nil {
+		return nil, err
+	}
+	for i := range result {
+		si := &result[i]
+		si.Text = payloadText(si.Payload, si.Result, si.Metrics)
+	}
+	return result, nil
+}
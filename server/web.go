@@ -0,0 +1,242 @@
+// Copyright 2018 Alexander Zaytsev <thebestzorro@yandex.ru>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package main implements server part of Meerkat project.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// webTimeout is a timeout for web admin requests handling.
+	webTimeout = 10 * time.Second
+	// layoutTemplate is a common HTML pages layout.
+	layoutTemplate = `{{define "layout"}}<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Meerkat</title>
+</head>
+<body>
+	<h1><a href="/">Meerkat</a></h1>
+	<p><a href="/">Clients</a> | <a href="/alerts">Alerts</a></p>
+	{{template "content" .}}
+</body>
+</html>{{end}}`
+	// clientsTemplate is HTML template of clients list.
+	clientsTemplate = `{{define "content"}}<h2>Clients</h2>
+<table border="1">
+	<tr><th>Client</th><th>Address</th><th>Host</th><th>OS</th><th>Version</th><th>Services</th><th>First seen</th><th>Last seen</th></tr>
+	{{range .}}<tr>
+		<td><a href="/client?id={{.ClientID}}">{{.Name}}</a></td>
+		<td>{{.Addr}}</td>
+		{{with .Host}}<td>{{.Hostname}}</td><td>{{.OS}}</td><td>{{.Version}} {{.Revision}}</td>{{else}}<td></td><td></td><td></td>{{end}}
+		<td>{{if .Registered}}{{range .Registered}}{{.Name}} {{end}}{{else}}{{range .Services}}{{.}} {{end}}{{end}}</td>
+		<td>{{.FirstSeen.Format "2006-01-02 15:04:05 MST"}}</td>
+		<td>{{.LastSeen.Format "2006-01-02 15:04:05 MST"}}</td>
+	</tr>{{end}}
+</table>{{end}}`
+	// servicesTemplate is HTML template of client's services list.
+	servicesTemplate = `{{define "content"}}<h2>Client {{with .Client}}{{.Name}}{{else}}{{.ClientID}}{{end}}</h2>
+{{with .Client}}{{with .Host}}<p>Host {{.Hostname}}, OS {{.OS}}, version {{.Version}} {{.Revision}}</p>{{end}}
+{{if .Registered}}<h3>Registered services</h3>
+<table border="1">
+	<tr><th>ID</th><th>Name</th><th>Type</th><th>Period</th></tr>
+	{{range .Registered}}<tr>
+		<td>{{.ID}}</td>
+		<td>{{.Name}}</td>
+		<td>{{.Type}}</td>
+		<td>{{.Period}}</td>
+	</tr>{{end}}
+</table>
+<p>Registered at {{.RegisteredAt.Format "2006-01-02 15:04:05 MST"}}</p>{{end}}{{end}}
+<h3>Latest data</h3>
+<table border="1">
+	<tr><th>Service</th><th>Address</th><th>Measured</th><th>Last seen</th><th>Payload</th></tr>
+	{{range .Services}}<tr>
+		<td>{{.ServiceID}}{{if .Name}} ({{.Name}}){{end}}</td>
+		<td>{{.Addr}}</td>
+		<td>{{.Measured.Format "2006-01-02 15:04:05 MST"}}</td>
+		<td>{{.LastSeen.Format "2006-01-02 15:04:05 MST"}}</td>
+		<td><pre>{{.Text}}</pre></td>
+	</tr>{{end}}
+</table>{{end}}`
+	// alertsTemplate is HTML template of alerts list.
+	alertsTemplate = `{{define "content"}}<h2>Alerts: {{.State}}</h2>
+<p><a href="/alerts?state=firing">firing</a> | <a href="/alerts?state=resolved">resolved</a></p>
+<table border="1">
+	<tr><th>Kind</th><th>Client</th><th>Service</th><th>Message</th><th>Started</th><th>Resolved</th></tr>
+	{{range .Alerts}}<tr>
+		<td>{{.Kind}}</td>
+		<td><a href="/client?id={{.ClientID}}">{{.ClientName}}</a></td>
+		<td>{{.ServiceID}}{{if .Service}} ({{.Service}}){{end}}</td>
+		<td>{{.Message}}</td>
+		<td>{{.Started.Format "2006-01-02 15:04:05 MST"}}</td>
+		<td>{{if not .Resolved.IsZero}}{{.Resolved.Format "2006-01-02 15:04:05 MST"}}{{end}}</td>
+	</tr>{{end}}
+</table>{{end}}`
+	// alertsLimit is max number of alerts in the list.
+	alertsLimit = 500
+)
+
+var (
+	clientsPage  = template.Must(template.Must(template.New("clients").Parse(layoutTemplate)).Parse(clientsTemplate))
+	servicesPage = template.Must(template.Must(template.New("services").Parse(layoutTemplate)).Parse(servicesTemplate))
+	alertsPage   = template.Must(template.Must(template.New("alerts").Parse(layoutTemplate)).Parse(alertsTemplate))
+)
+
+// clientServices is a client info with its services.
+type clientServices struct {
+	ClientID string        `json:"client_id"`
+	Client   *ClientInfo   `json:"client"`
+	Services []ServiceInfo `json:"services"`
+}
+
+// stateAlerts is alerts list with the state.
+type stateAlerts struct {
+	State  string  `json:"state"`
+	Alerts []Alert `json:"alerts"`
+}
+
+// writeJSON writes JSON encoded value to the response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		loggerError.Printf("json response error: %v\n", err)
+	}
+}
+
+// writeHTML writes HTML page to the response.
+func writeHTML(w http.ResponseWriter, t *template.Template, v interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.ExecuteTemplate(w, "layout", v); err != nil {
+		loggerError.Printf("html response error: %v\n", err)
+	}
+}
+
+// clientsHandler returns a handler of known clients list.
+func clientsHandler(ctx context.Context, asJSON bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && !asJSON {
+			http.NotFound(w, r)
+			return
+		}
+		clients, err := Clients(ctx)
+		if err != nil {
+			loggerError.Printf("clients request error: %v\n", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if asJSON {
+			writeJSON(w, clients)
+		} else {
+			writeHTML(w, clientsPage, clients)
+		}
+	}
+}
+
+// servicesHandler returns a handler of client's services list.
+func servicesHandler(ctx context.Context, asJSON bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientID := r.URL.Query().Get("id")
+		if clientID == "" {
+			http.Error(w, "client id is required", http.StatusBadRequest)
+			return
+		}
+		client, err := FindClient(ctx, clientID)
+		if err != nil {
+			loggerError.Printf("client request error: %v\n", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		services, err := Services(ctx, clientID)
+		if err != nil {
+			loggerError.Printf("services request error: %v\n", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		result := &clientServices{ClientID: clientID, Client: client, Services: services}
+		if asJSON {
+			writeJSON(w, result)
+		} else {
+			writeHTML(w, servicesPage, result)
+		}
+	}
+}
+
+// alertsHandler returns a handler of alerts list.
+func alertsHandler(ctx context.Context, asJSON bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := r.URL.Query().Get("state")
+		switch state {
+		case "":
+			state = alertFiring
+		case alertFiring, alertResolved:
+		default:
+			http.Error(w, "unknown alert state", http.StatusBadRequest)
+			return
+		}
+		alerts, err := Alerts(ctx, state, alertsLimit)
+		if err != nil {
+			loggerError.Printf("alerts request error: %v\n", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		result := &stateAlerts{State: state, Alerts: alerts}
+		if asJSON {
+			writeJSON(w, result)
+		} else {
+			writeHTML(w, alertsPage, result)
+		}
+	}
+}
+
+// metricsHandler returns server metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, counters.Snapshot())
+}
+
+// webServer returns new web admin HTTP server.
+func webServer(ctx context.Context, cfg *WebAdmin) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", clientsHandler(ctx, false))
+	mux.HandleFunc("/client", servicesHandler(ctx, false))
+	mux.HandleFunc("/api/clients", clientsHandler(ctx, true))
+	mux.HandleFunc("/alerts", alertsHandler(ctx, false))
+	mux.HandleFunc("/api/client", servicesHandler(ctx, true))
+	mux.HandleFunc("/api/alerts", alertsHandler(ctx, true))
+	mux.HandleFunc("/api/metrics", metricsHandler)
+	return &http.Server{
+		Addr:         cfg.Addr(),
+		Handler:      http.TimeoutHandler(mux, webTimeout, "timeout"),
+		ReadTimeout:  webTimeout,
+		WriteTimeout: webTimeout,
+	}
+}
+
+// runWebServer starts web admin HTTP server.
+func runWebServer(srv *http.Server, wg *sync.WaitGroup) {
+	defer wg.Done()
+	loggerInfo.Printf("web admin is listening on %v\n", srv.Addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		loggerError.Printf("web admin error: %v\n", err)
+	}
+}